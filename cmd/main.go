@@ -1,11 +1,59 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/SardorMS/wallet/pkg/types"
 	"github.com/SardorMS/wallet/pkg/wallet"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(verify(os.Args[2:]))
+	}
+
+	demo()
+}
+
+// verify - checks the integrity of the dump directory, the records
+// which can't be read are reported as well, usage: wallet verify <dir>.
+func verify(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: wallet verify <dir>")
+		return 2
+	}
+
+	svc := &wallet.Service{}
+	report, err := svc.VerifyDir(args[0])
+	if report == nil {
+		fmt.Fprintln(os.Stderr, "verify:", err)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+	}
+
+	fmt.Printf("accounts: %d, payments: %d, favorites: %d, transfers: %d, deposits: %d, postings: %d\n",
+		report.Accounts, report.Payments, report.Favorites, report.Transfers, report.Deposits, report.Postings)
+
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+
+	if !report.OK() {
+		fmt.Printf("%d issue(s) found\n", len(report.Issues))
+		return 1
+	}
+	if err != nil {
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
+
+// demo - fills the service with sample data and exports it.
+func demo() {
 	svc := &wallet.Service{}
 
 	svc.RegisterAccount("+1111")
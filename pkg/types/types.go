@@ -1,5 +1,11 @@
 package types
 
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
 //Money - represents a monetary amount
 //in minimum units (cents, kopecks, diramas, etc.).
 type Money int64
@@ -18,13 +24,153 @@ const (
 	PaymentStatusInProgress PaymentStatus = "INPROGRESS"
 )
 
+//paymentTransitions - allowed changes of the payment status.
+//OK and FAIL are final, a payment can't leave them.
+var paymentTransitions = map[PaymentStatus][]PaymentStatus{
+	PaymentStatusInProgress: {PaymentStatusOK, PaymentStatusFail},
+	PaymentStatusOK:         {},
+	PaymentStatusFail:       {},
+}
+
+//IsValid - reports whether the status is one of the predefined ones.
+func (s PaymentStatus) IsValid() bool {
+	_, ok := paymentTransitions[s]
+	return ok
+}
+
+//CanRepeat - reports whether the payment in the status may be repeated:
+//only finished ones are, the one in progress is yet to be confirmed or rejected.
+func (s PaymentStatus) CanRepeat() bool {
+	return s == PaymentStatusOK || s == PaymentStatusFail
+}
+
+//CanTransitionTo - reports whether the status may change to the next one.
+func (s PaymentStatus) CanTransitionTo(next PaymentStatus) bool {
+	for _, status := range paymentTransitions[s] {
+		if status == next {
+			return true
+		}
+	}
+	return false
+}
+
 //Payment - represents information about the payment source.
 type Payment struct {
-	ID        string
-	AccountID int64
-	Amount    Money
-	Category  PaymentCategory
-	Status    PaymentStatus
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
+	Status    PaymentStatus   `json:"status"`
+	Created   time.Time       `json:"created"`
+	Updated   time.Time       `json:"updated"`
+}
+
+//Transfer - represents information about the money transfer
+//between two accounts.
+type Transfer struct {
+	ID            string        `json:"id"`
+	FromAccountID int64         `json:"from_account_id"`
+	ToAccountID   int64         `json:"to_account_id"`
+	Amount        Money         `json:"amount"`
+	Status        PaymentStatus `json:"status"`
+	Created       time.Time     `json:"created"`
+	Updated       time.Time     `json:"updated"`
+}
+
+//Deposit - represents information about the replenishment of the account.
+type Deposit struct {
+	ID        string    `json:"id"`
+	AccountID int64     `json:"account_id"`
+	Amount    Money     `json:"amount"`
+	Created   time.Time `json:"created"`
+}
+
+//EntryType - represents the kind of the ledger entry.
+type EntryType string
+
+//Predefined ledger entry types.
+const (
+	EntryDeposit     EntryType = "DEPOSIT"
+	EntryPayment     EntryType = "PAYMENT"
+	EntryRefund      EntryType = "REFUND"
+	EntryTransferIn  EntryType = "TRANSFER_IN"
+	EntryTransferOut EntryType = "TRANSFER_OUT"
+	EntryReversal    EntryType = "REVERSAL"
+	EntryTransfer    EntryType = "TRANSFER"
+	EntryOpening     EntryType = "OPENING"
+)
+
+//Entry - represents a single change of the account balance:
+//a credit(positive amount) or a debit(negative amount).
+//Balance is the balance of the account after the entry,
+//Reference is the ID of the deposit, payment or transfer.
+type Entry struct {
+	ID        string    `json:"id"`
+	AccountID int64     `json:"account_id"`
+	Type      EntryType `json:"type"`
+	Amount    Money     `json:"amount"`
+	Balance   Money     `json:"balance"`
+	Reference string    `json:"reference"`
+	Created   time.Time `json:"created"`
+}
+
+//LedgerAccount - represents an account of the journal: either the account
+//of a customer or one of the system accounts.
+type LedgerAccount string
+
+//Predefined system accounts of the journal.
+const (
+	LedgerExternalFunding  LedgerAccount = "external_funding"
+	LedgerMerchantClearing LedgerAccount = "merchant_clearing"
+)
+
+//customerLedgerPrefix - prefix of the journal accounts of customers.
+const customerLedgerPrefix = "account:"
+
+//CustomerLedger - returns the journal account of the customer account.
+func CustomerLedger(accountID int64) LedgerAccount {
+	return LedgerAccount(customerLedgerPrefix + strconv.FormatInt(accountID, 10))
+}
+
+//AccountID - returns ID of the customer account, false for system accounts.
+func (a LedgerAccount) AccountID() (int64, bool) {
+	if !strings.HasPrefix(string(a), customerLedgerPrefix) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(string(a), customerLedgerPrefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+//Line - represents one side of the journal posting.
+type Line struct {
+	Account LedgerAccount `json:"account"`
+	Debit   Money         `json:"debit"`
+	Credit  Money         `json:"credit"`
+}
+
+//Posting - represents a balanced record of the journal: the sum of debits
+//of its lines is equal to the sum of credits. Reference is the ID
+//of the deposit, payment or transfer.
+type Posting struct {
+	ID        string    `json:"id"`
+	Type      EntryType `json:"type"`
+	Reference string    `json:"reference"`
+	Created   time.Time `json:"created"`
+	Lines     []Line    `json:"lines"`
+}
+
+//IdempotencyKey - represents the result of the operation made with
+//an idempotency key: Reference is the ID of the created payment or deposit,
+//Error is the text of the returned error(empty on success).
+type IdempotencyKey struct {
+	Key       string    `json:"key"`
+	Operation string    `json:"operation"`
+	Reference string    `json:"reference"`
+	Error     string    `json:"error"`
+	Created   time.Time `json:"created"`
 }
 
 //Phone - phone number.
@@ -32,16 +178,17 @@ type Phone string
 
 //Account - represents information about the account.
 type Account struct {
-	ID      int64
-	Phone   Phone
-	Balance Money
+	ID      int64 `json:"id"`
+	Phone   Phone `json:"phone"`
+	Balance Money `json:"balance"`
 }
 
 //Favorite - represents information about the favorite payment.
 type Favorite struct {
-	ID        string
-	AccountID int64
-	Name      string
-	Amount    Money
-	Category  PaymentCategory
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Name      string          `json:"name"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
+	Created   time.Time       `json:"created"`
 }
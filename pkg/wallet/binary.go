@@ -0,0 +1,270 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// BinaryVersion - the version of the binary snapshot written by ExportBinary.
+//
+// The snapshot starts with binaryMagic and the version byte, followed by
+// the gob stream of the ID of the last registered account and the sections
+// of all kinds. Every section is a binarySection followed by the chunks
+// (slices) of at most binaryChunk records, the empty section ends
+// the stream.
+const BinaryVersion = 1
+
+// binaryMagic - the first bytes of the binary snapshot.
+const binaryMagic = "WALLETBIN"
+
+// binaryChunk - the number of records encoded at once.
+const binaryChunk = 4096
+
+// binaryReserve - the most records reserved up front, so a broken count
+// can't make the import allocate too much, append grows the rest.
+const binaryReserve = binaryChunk
+
+// binarySection - the header of the records of the kind.
+type binarySection struct {
+	Kind  string
+	Count int
+}
+
+// ExportBinary - writes the whole state of the wallet as the binary
+// snapshot, which is much faster to load than the dump files.
+func (s *Service) ExportBinary(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	err := writeBinary(w, s.exportSnapshot(), s.nextAccountID)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	return nil
+}
+
+// writeBinary - writes the binary snapshot of the records.
+func writeBinary(w io.Writer, snap *snapshot, nextAccountID int64) error {
+	buf := bufio.NewWriter(w)
+	_, err := buf.WriteString(binaryMagic)
+	if err == nil {
+		err = buf.WriteByte(BinaryVersion)
+	}
+	if err != nil {
+		return err
+	}
+
+	enc := gob.NewEncoder(buf)
+	err = enc.Encode(nextAccountID)
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range recordKinds {
+		var count int
+		var chunk func(from, to int) interface{}
+		switch kind {
+		case kindAccount:
+			count, chunk = len(snap.accounts), func(from, to int) interface{} { return snap.accounts[from:to] }
+		case kindPayment:
+			count, chunk = len(snap.payments), func(from, to int) interface{} { return snap.payments[from:to] }
+		case kindFavorite:
+			count, chunk = len(snap.favorites), func(from, to int) interface{} { return snap.favorites[from:to] }
+		case kindTransfer:
+			count, chunk = len(snap.transfers), func(from, to int) interface{} { return snap.transfers[from:to] }
+		case kindDeposit:
+			count, chunk = len(snap.deposits), func(from, to int) interface{} { return snap.deposits[from:to] }
+		case kindPosting:
+			count, chunk = len(snap.postings), func(from, to int) interface{} { return snap.postings[from:to] }
+		case kindKey:
+			count, chunk = len(snap.keys), func(from, to int) interface{} { return snap.keys[from:to] }
+		}
+
+		err = enc.Encode(binarySection{Kind: string(kind), Count: count})
+		if err != nil {
+			return err
+		}
+
+		for from := 0; from < count; from += binaryChunk {
+			to := from + binaryChunk
+			if to > count {
+				to = count
+			}
+
+			err = enc.Encode(chunk(from, to))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = enc.Encode(binarySection{})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// ImportBinary - import(reads) the binary snapshot written by ExportBinary.
+// The records are merged the same way as by Import, the snapshot which
+// can't be read is not imported at all.
+func (s *Service) ImportBinary(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, err := readBinary(r)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	return s.importSnapshot(snap, nil)
+}
+
+// readBinary - reads the binary snapshot.
+func readBinary(r io.Reader) (*snapshot, error) {
+	r = bufio.NewReader(r)
+
+	header := make([]byte, len(binaryMagic)+1)
+	_, err := io.ReadFull(r, header)
+	if err != nil || !bytes.HasPrefix(header, []byte(binaryMagic)) {
+		return nil, &ImportError{Reason: "not a binary snapshot", Err: ErrMalformedRecord}
+	}
+
+	version := int(header[len(binaryMagic)])
+	if version < 1 || version > BinaryVersion {
+		return nil, &ImportError{
+			Field:  "version",
+			Reason: fmt.Sprintf("version %d, supported up to %d", version, BinaryVersion),
+			Err:    ErrUnsupportedVersion,
+		}
+	}
+
+	snap := newSnapshot()
+	snap.stream = true
+	dec := gob.NewDecoder(r)
+	broken := func(kind string, err error) error {
+		return &ImportError{File: kind, Reason: err.Error(), Err: ErrMalformedRecord}
+	}
+
+	err = dec.Decode(&snap.nextAccountID)
+	if err != nil {
+		return nil, broken("", err)
+	}
+
+	for {
+		var section binarySection
+		err = dec.Decode(&section)
+		if err != nil {
+			return nil, broken("", err)
+		}
+		if section.Kind == "" {
+			break
+		}
+
+		kind := recordKind(section.Kind)
+		if !isRecordKind(kind) || snap.found[kind] || section.Count < 0 {
+			return nil, broken(section.Kind, fmt.Errorf("unexpected section of %d records", section.Count))
+		}
+		snap.found[kind] = true
+
+		read := 0
+		for read < section.Count {
+			count, err := snap.decodeBinary(dec, kind, section.Count)
+			if err != nil {
+				return nil, broken(section.Kind, err)
+			}
+			read += count
+		}
+		if read != section.Count {
+			return nil, broken(section.Kind, fmt.Errorf("section says %d records, found %d", section.Count, read))
+		}
+
+		// the records are numbered as lines in the errors of the merge.
+		for i := 0; i < section.Count; i++ {
+			snap.lines[kind] = append(snap.lines[kind], i+1)
+		}
+	}
+	return snap, nil
+}
+
+// decodeBinary - adds the next chunk of the records of the kind
+// and returns the number of the records in it. The first chunk reserves
+// the room for the records of the section, binaryReserve at most.
+func (snap *snapshot) decodeBinary(dec *gob.Decoder, kind recordKind, total int) (int, error) {
+	if total > binaryReserve {
+		total = binaryReserve
+	}
+
+	var err error
+	var count int
+	switch kind {
+	case kindAccount:
+		if snap.accounts == nil {
+			snap.accounts = make([]types.Account, 0, total)
+		}
+		var chunk []types.Account
+		err = dec.Decode(&chunk)
+		count = len(chunk)
+		snap.accounts = append(snap.accounts, chunk...)
+	case kindPayment:
+		if snap.payments == nil {
+			snap.payments = make([]types.Payment, 0, total)
+		}
+		var chunk []types.Payment
+		err = dec.Decode(&chunk)
+		count = len(chunk)
+		snap.payments = append(snap.payments, chunk...)
+	case kindFavorite:
+		if snap.favorites == nil {
+			snap.favorites = make([]types.Favorite, 0, total)
+		}
+		var chunk []types.Favorite
+		err = dec.Decode(&chunk)
+		count = len(chunk)
+		snap.favorites = append(snap.favorites, chunk...)
+	case kindTransfer:
+		if snap.transfers == nil {
+			snap.transfers = make([]types.Transfer, 0, total)
+		}
+		var chunk []types.Transfer
+		err = dec.Decode(&chunk)
+		count = len(chunk)
+		snap.transfers = append(snap.transfers, chunk...)
+	case kindDeposit:
+		if snap.deposits == nil {
+			snap.deposits = make([]types.Deposit, 0, total)
+		}
+		var chunk []types.Deposit
+		err = dec.Decode(&chunk)
+		count = len(chunk)
+		snap.deposits = append(snap.deposits, chunk...)
+	case kindPosting:
+		if snap.postings == nil {
+			snap.postings = make([]types.Posting, 0, total)
+		}
+		var chunk []types.Posting
+		err = dec.Decode(&chunk)
+		count = len(chunk)
+		snap.postings = append(snap.postings, chunk...)
+	case kindKey:
+		if snap.keys == nil {
+			snap.keys = make([]types.IdempotencyKey, 0, total)
+		}
+		var chunk []types.IdempotencyKey
+		err = dec.Decode(&chunk)
+		count = len(chunk)
+		snap.keys = append(snap.keys, chunk...)
+	}
+
+	if err == nil && count == 0 {
+		err = fmt.Errorf("empty chunk of %s", kind)
+	}
+	return count, err
+}
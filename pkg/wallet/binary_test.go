@@ -0,0 +1,265 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+func TestService_ExportBinary_roundTrip(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	payment, err := s.Pay(2, 20, "rent; March\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.FavoritePayment(payment.ID, "my rent")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Transfer(1, 3, 50)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.ExportBinary(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	imported.SetImportMode(ImportStrict)
+	err = imported.ImportBinary(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(takeSnapshot(imported.store()), takeSnapshot(s.store())) {
+		t.Errorf("ImportBinary(): wrong records imported")
+	}
+
+	if imported.nextAccountID != s.nextAccountID {
+		t.Errorf("ImportBinary(): wrong nextAccountID = %v, want %v", imported.nextAccountID, s.nextAccountID)
+	}
+}
+
+func TestService_ImportBinary_badRecords(t *testing.T) {
+	snap := &snapshot{
+		accounts: []types.Account{{ID: 1, Phone: "+1111", Balance: 100}},
+		payments: []types.Payment{
+			{ID: "p1", AccountID: 1, Amount: 10, Category: "auto", Status: types.PaymentStatusOK},
+			{ID: "p2", AccountID: 1, Amount: 10, Category: "auto", Status: "DONE"},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	err := writeBinary(buf, snap, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.ImportBinary(buf)
+
+	var errs ImportErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].File != "payments" || errs[0].Line != 2 {
+		t.Errorf("ImportBinary(): wrong errors = %v", err)
+		return
+	}
+
+	if len(s.store().Payments()) != 1 {
+		t.Errorf("ImportBinary(): wrong payments imported = %v", s.store().Payments())
+	}
+}
+
+func TestService_ImportBinary_broken(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	buf := &bytes.Buffer{}
+	err := s.ExportBinary(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data := buf.Bytes()
+
+	newer := append([]byte{}, data...)
+	newer[len(binaryMagic)] = BinaryVersion + 1
+
+	snapshots := map[string]error{
+		"empty":     ErrMalformedRecord,
+		"text":      ErrMalformedRecord,
+		"truncated": ErrMalformedRecord,
+		"newer":     ErrUnsupportedVersion,
+	}
+	inputs := map[string][]byte{
+		"empty":     nil,
+		"text":      []byte("1;+1111;400\n"),
+		"truncated": data[:len(data)/2],
+		"newer":     newer,
+	}
+
+	for name, want := range snapshots {
+		imported := newTestService()
+		err := imported.ImportBinary(bytes.NewReader(inputs[name]))
+		if !errors.Is(err, want) {
+			t.Errorf("ImportBinary(%s): must return %v, returned = %v", name, want, err)
+		}
+
+		if len(imported.store().Accounts()) != 0 {
+			t.Errorf("ImportBinary(%s): broken snapshot imported", name)
+		}
+	}
+}
+
+func TestService_ImportBinary_forgedCount(t *testing.T) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(binaryMagic)
+	buf.WriteByte(BinaryVersion)
+
+	// the section says 100M payments, one is there.
+	enc := gob.NewEncoder(buf)
+	enc.Encode(int64(1))
+	enc.Encode(binarySection{Kind: string(kindPayment), Count: 100_000_000})
+	enc.Encode([]types.Payment{{ID: "p1", AccountID: 1, Amount: 1, Status: types.PaymentStatusOK}})
+	enc.Encode(binarySection{})
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	s := newTestService()
+	err := s.ImportBinary(bytes.NewReader(buf.Bytes()))
+	if !errors.Is(err, ErrMalformedRecord) {
+		t.Errorf("ImportBinary(): must return ErrMalformedRecord, returned = %v", err)
+	}
+
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Errorf("ImportBinary(): %d bytes allocated for the forged count", allocated)
+	}
+}
+
+// benchmarkPayments - the number of payments of the benchmarks of loading.
+const benchmarkPayments = 1000000
+
+// benchmarkStorageService - returns the service with the accounts
+// and the payments put directly to the storage.
+func benchmarkStorageService(payments int) *testService {
+	s := newTestService()
+	created := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	changes := []change{}
+	for id := int64(1); id <= 1000; id++ {
+		changes = append(changes, change{kind: kindAccount, record: types.Account{ID: id, Phone: types.Phone("+" + strconv.FormatInt(id, 10)), Balance: 1000}})
+	}
+	for i := 0; i < payments; i++ {
+		changes = append(changes, change{kind: kindPayment, record: types.Payment{
+			ID:        "payment-" + strconv.Itoa(i),
+			AccountID: int64(i%1000 + 1),
+			Amount:    types.Money(i%500 + 1),
+			Category:  "auto",
+			Status:    types.PaymentStatusOK,
+			Created:   created.Add(time.Duration(i) * time.Second),
+			Updated:   created.Add(time.Duration(i) * time.Second),
+		}})
+	}
+	s.memory().apply(changes)
+	s.nextAccountID = 1000
+	return s
+}
+
+func BenchmarkImport_text(b *testing.B) {
+	s := benchmarkStorageService(benchmarkPayments)
+	dir := b.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := newTestService().Import(dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkImport_binary(b *testing.B) {
+	s := benchmarkStorageService(benchmarkPayments)
+	buf := &bytes.Buffer{}
+	err := s.ExportBinary(buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Logf("binary snapshot of %d payments: %d bytes", benchmarkPayments, buf.Len())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := newTestService().ImportBinary(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadSnapshot_text(b *testing.B) {
+	s := benchmarkStorageService(benchmarkPayments)
+	dir := b.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	path, err := snapshotDir(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, errs := readSnapshot(path, dumpCodec{})
+		if errs != nil {
+			b.Fatal(errs)
+		}
+	}
+}
+
+func BenchmarkReadSnapshot_binary(b *testing.B) {
+	s := benchmarkStorageService(benchmarkPayments)
+	buf := &bytes.Buffer{}
+	err := s.ExportBinary(buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := readBinary(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package wallet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"os"
+)
+
+// Permissions of the directories and files written by the service:
+// the dumps hold phones and balances, so only the owner may read them.
+const (
+	dirPerm  os.FileMode = 0700
+	filePerm os.FileMode = 0600
+)
+
+// encryptedMagic - the first bytes of the encrypted dump file, followed
+// by the version byte, the nonce and the data sealed by AES-GCM.
+const encryptedMagic = "WALLETENC"
+
+// encryptedVersion - the version of the encrypted dump files.
+const encryptedVersion = 1
+
+// gzipMagic - the first bytes of the gzip stream.
+const gzipMagic = "\x1f\x8b"
+
+// dumpCodec - the optional compression and encryption of the dump files.
+// The data is compressed first and then encrypted, on reading both are
+// detected by the first bytes of the file.
+type dumpCodec struct {
+	compress bool
+	aead     cipher.AEAD
+}
+
+// SetCompression - turns on(or off) the gzip compression of the files
+// written by Export, ExportDump and HistoryToFiles.
+func (s *Service) SetCompression(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.codec.compress = enabled
+}
+
+// SetEncryptionKey - turns on the AES-GCM encryption of the files written
+// by Export, ExportDump and HistoryToFiles with the key of 16, 24 or 32
+// bytes, the same key is needed to import them. The nil key turns
+// the encryption off.
+func (s *Service) SetEncryptionKey(key []byte) error {
+	var aead cipher.AEAD
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+
+		aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.codec.aead = aead
+	return nil
+}
+
+// seal - returns the data compressed and encrypted as set.
+func (c dumpCodec) seal(data []byte) ([]byte, error) {
+	if c.compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(data)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+
+	if c.aead != nil {
+		header := append([]byte(encryptedMagic), encryptedVersion)
+		nonce := make([]byte, c.aead.NonceSize())
+		_, err := io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		sealed := append(header, nonce...)
+		data = c.aead.Seal(sealed, nonce, data, header)
+	}
+	return data, nil
+}
+
+// open - returns the data of the file written by seal, the plain files
+// are returned as they are. The file which can't be opened is returned
+// as the error without the file name.
+func (c dumpCodec) open(data []byte) ([]byte, *ImportError) {
+	if bytes.HasPrefix(data, []byte(encryptedMagic)) {
+		if c.aead == nil {
+			return nil, &ImportError{Reason: "the file is encrypted, the key is not set", Err: ErrEncryptionKeyMissing}
+		}
+
+		size := len(encryptedMagic) + 1
+		if len(data) < size+c.aead.NonceSize() || data[size-1] != encryptedVersion {
+			return nil, &ImportError{Reason: "bad header of the encrypted file", Err: ErrDecryptionFailed}
+		}
+
+		nonce := data[size : size+c.aead.NonceSize()]
+		plain, err := c.aead.Open(nil, nonce, data[size+len(nonce):], data[:size])
+		if err != nil {
+			return nil, &ImportError{Reason: "wrong key or the file is corrupted", Err: ErrDecryptionFailed}
+		}
+		data = plain
+	}
+
+	if bytes.HasPrefix(data, []byte(gzipMagic)) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			data, err = io.ReadAll(zr)
+		}
+		if err != nil {
+			return nil, &ImportError{Reason: "bad compressed data: " + err.Error(), Err: ErrChecksumMismatch}
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,234 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestService_Export_sealed(t *testing.T) {
+	options := map[string]func(s *testService) error{
+		"plain": func(s *testService) error { return nil },
+		"gzip": func(s *testService) error {
+			s.SetCompression(true)
+			return nil
+		},
+		"aes": func(s *testService) error {
+			return s.SetEncryptionKey(testKey)
+		},
+		"gzip+aes": func(s *testService) error {
+			s.SetCompression(true)
+			return s.SetEncryptionKey(testKey)
+		},
+	}
+
+	for name, set := range options {
+		s := newTestService()
+		Transactions(s)
+		err := set(s)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		dir := t.TempDir()
+		err = s.Export(dir)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		path, _ := snapshotDir(dir)
+		data, err := os.ReadFile(filepath.Join(path, "accounts.dump"))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		prefix := map[string]string{"plain": "#dump", "gzip": gzipMagic, "aes": encryptedMagic, "gzip+aes": encryptedMagic}[name]
+		if !strings.HasPrefix(string(data), prefix) {
+			t.Errorf("Export(%s): wrong data = %q", name, data)
+		}
+
+		if prefix == encryptedMagic && strings.Contains(string(data), "2222") {
+			t.Errorf("Export(%s): phones are not encrypted, data = %q", name, data)
+		}
+
+		// the files are detected by themselves, only the key is needed.
+		imported := newTestService()
+		imported.SetImportMode(ImportStrict)
+		imported.SetEncryptionKey(testKey)
+		err = imported.Import(dir)
+		if err != nil {
+			t.Errorf("Import(%s): error = %v", name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(takeSnapshot(imported.store()), takeSnapshot(s.store())) {
+			t.Errorf("Import(%s): wrong records imported", name)
+		}
+	}
+}
+
+func TestService_Import_wrongKey(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+	s.SetCompression(true)
+	err := s.SetEncryptionKey(testKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if !errors.Is(err, ErrEncryptionKeyMissing) {
+		t.Errorf("Import(): must return ErrEncryptionKeyMissing, returned = %v", err)
+	}
+
+	err = imported.SetEncryptionKey([]byte("fedcba9876543210"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = imported.Import(dir)
+	if !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Import(): must return ErrDecryptionFailed, returned = %v", err)
+	}
+
+	if len(imported.store().Accounts()) != 0 {
+		t.Errorf("Import(): accounts imported without the key = %v", imported.store().Accounts())
+	}
+
+	err = imported.SetEncryptionKey([]byte("short"))
+	if err == nil {
+		t.Errorf("SetEncryptionKey(): must return error for the key of wrong size")
+	}
+}
+
+func TestService_HistoryToFiles_sealed(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+	s.SetCompression(true)
+	err := s.SetEncryptionKey(testKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payments, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir() + "/history"
+	err = s.HistoryToFiles(payments, dir, 5)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, name := range []string{"payments1.dump", "payments2.dump"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		data, ferr := s.codec.open(data)
+		if ferr != nil {
+			t.Errorf("HistoryToFiles(): can't open %s, error = %v", name, ferr)
+			continue
+		}
+
+		if _, _, ferr := decodeDump(data); ferr != nil {
+			t.Errorf("HistoryToFiles(): %s is broken, error = %v", name, ferr)
+		}
+	}
+}
+
+func TestService_ExportDump_sealed(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+	err := s.SetEncryptionKey(testKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.ExportDump(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if bytes.Contains(buf.Bytes(), []byte("2222")) {
+		t.Errorf("ExportDump(): accounts are not encrypted")
+	}
+
+	imported := newTestService()
+	imported.SetEncryptionKey(testKey)
+	err = imported.ImportDump(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(takeSnapshot(imported.store()), takeSnapshot(s.store())) {
+		t.Errorf("ImportDump(): wrong records imported")
+	}
+}
+
+func TestService_Export_permissions(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir() + "/dump"
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payments, _ := s.ExportAccountHistory(1)
+	err = s.HistoryToFiles(payments, dir+"/history", 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.ExportToFile(dir + "/accounts.txt")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			t.Errorf("Export(): %s is open to others, mode = %v", path, info.Mode())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,789 @@
+package wallet
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// snapshot - copies of all records of the storage,
+// in the form they are written to the dump files.
+type snapshot struct {
+	accounts  []types.Account
+	payments  []types.Payment
+	favorites []types.Favorite
+	transfers []types.Transfer
+	deposits  []types.Deposit
+	postings  []types.Posting
+	keys      []types.IdempotencyKey
+
+	// found - the kinds whose dump files were read by readSnapshot,
+	// lines - the line numbers of the records read of every kind.
+	found map[recordKind]bool
+	lines map[recordKind][]int
+
+	// nextAccountID - the ID of the last registered account, if known,
+	// stream - the records are read from a single stream(the JSON document
+	// or the binary snapshot), whose parts are named by the kinds.
+	nextAccountID int64
+	stream        bool
+
+	// increment - the checkpoints and the deleted records of the snapshot
+	// written by ExportIncrement, nil for the whole one.
+	increment *increment
+}
+
+// takeSnapshot - copies all records of the storage.
+func takeSnapshot(storage Storage) *snapshot {
+	snap := &snapshot{}
+	for _, account := range storage.Accounts() {
+		snap.accounts = append(snap.accounts, *account)
+	}
+	for _, payment := range storage.Payments() {
+		snap.payments = append(snap.payments, *payment)
+	}
+	for _, favorite := range storage.Favorites() {
+		snap.favorites = append(snap.favorites, *favorite)
+	}
+	for _, transfer := range storage.Transfers() {
+		snap.transfers = append(snap.transfers, *transfer)
+	}
+	for _, deposit := range storage.Deposits() {
+		snap.deposits = append(snap.deposits, *deposit)
+	}
+	for _, posting := range storage.Postings() {
+		snap.postings = append(snap.postings, *posting)
+	}
+
+	keys := append([]*types.IdempotencyKey{}, storage.IdempotencyKeys()...)
+	sortKeys(keys)
+	for _, record := range keys {
+		snap.keys = append(snap.keys, *record)
+	}
+	return snap
+}
+
+// sortKeys - sorts the idempotency keys by the time they were created,
+// so the dump of the same keys is always the same.
+func sortKeys(keys []*types.IdempotencyKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Key < keys[j].Key
+		}
+		return keys[i].Created.Before(keys[j].Created)
+	})
+}
+
+// file - returns the name of the source of the records of the kind,
+// used in the errors: the dump file or the part of the stream.
+func (snap *snapshot) file(kind recordKind) string {
+	if snap.stream {
+		return string(kind)
+	}
+	return string(kind) + ".dump"
+}
+
+// dumpPath - returns the path of the dump file of the kind.
+func dumpPath(dir string, kind recordKind) string {
+	return filepath.Join(dir, string(kind)+".dump")
+}
+
+// encode - returns the dump file of the kind.
+func (snap *snapshot) encode(kind recordKind) []byte {
+	return encodeDump(snap.records(kind))
+}
+
+// records - returns the dump lines of the records of the kind.
+func (snap *snapshot) records(kind recordKind) []string {
+	records := []string{}
+	switch kind {
+	case kindAccount:
+		for _, account := range snap.accounts {
+			records = append(records, formatAccount(account))
+		}
+	case kindPayment:
+		for _, payment := range snap.payments {
+			records = append(records, formatPayment(payment))
+		}
+	case kindFavorite:
+		for _, favorite := range snap.favorites {
+			records = append(records, formatFavorite(favorite))
+		}
+	case kindTransfer:
+		for _, transfer := range snap.transfers {
+			records = append(records, formatTransfer(transfer))
+		}
+	case kindDeposit:
+		for _, deposit := range snap.deposits {
+			records = append(records, formatDeposit(deposit))
+		}
+	case kindPosting:
+		for _, posting := range snap.postings {
+			records = append(records, formatPosting(posting))
+		}
+	case kindKey:
+		for _, record := range snap.keys {
+			records = append(records, formatKey(record))
+		}
+	}
+	return records
+}
+
+// newSnapshot - returns the empty snapshot to read the records into.
+func newSnapshot() *snapshot {
+	return &snapshot{
+		found: make(map[recordKind]bool),
+		lines: make(map[recordKind][]int),
+	}
+}
+
+// readSnapshot - reads all dump files of the directory, the missing ones
+// are skipped. The lines which can't be read are skipped as well
+// and returned as the errors.
+func readSnapshot(dir string, codec dumpCodec) (*snapshot, ImportErrors) {
+	snap := newSnapshot()
+
+	var errs ImportErrors
+	for _, kind := range recordKinds {
+		data, err := os.ReadFile(dumpPath(dir, kind))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		errs = append(errs, snap.read(kind, data, codec)...)
+	}
+	return snap, errs
+}
+
+// readDump - reads the snapshot of the dump directory written by Export:
+// the current generation, or the directory itself for the older dumps,
+// whose missing files have no records. ErrSnapshotNotFound is returned
+// if there is no directory, or CURRENT names the generation which
+// is missing or lacks any of the files.
+func readDump(dir string, codec dumpCodec) (*snapshot, ImportErrors, error) {
+	// the empty one is the current directory, as for the files.
+	info, err := os.Stat(filepath.Clean(dir))
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", dir)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, err)
+	}
+
+	generation, err := currentGeneration(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if generation == "" {
+		snap, errs := readSnapshot(dir, codec)
+		return snap, errs, nil
+	}
+
+	path := filepath.Join(dir, generation)
+	for _, kind := range recordKinds {
+		_, err := os.Stat(dumpPath(path, kind))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, err)
+		}
+	}
+
+	snap, errs := readSnapshot(path, codec)
+	return snap, errs, nil
+}
+
+// read - adds the records of the dump file of the kind, compressed or
+// encrypted ones are opened by the codec. The lines which can't be read
+// are skipped and returned as the errors.
+func (snap *snapshot) read(kind recordKind, data []byte, codec dumpCodec) ImportErrors {
+	snap.found[kind] = true
+
+	data, ferr := codec.open(data)
+	if ferr != nil {
+		ferr.File = snap.file(kind)
+		return ImportErrors{ferr}
+	}
+
+	lines, version, ferr := decodeDump(data)
+	if ferr != nil {
+		ferr.File = snap.file(kind)
+		return ImportErrors{ferr}
+	}
+
+	var errs ImportErrors
+	for _, line := range lines {
+		fields := migrate(kind, version, splitFields(version, line.text))
+		err := snap.decode(kind, fields)
+		if err != nil {
+			err.File = snap.file(kind)
+			err.Line = line.number
+			errs = append(errs, err)
+			continue
+		}
+		snap.lines[kind] = append(snap.lines[kind], line.number)
+	}
+	return errs
+}
+
+// writeArchive - writes the dump files of all kinds as the tar archive,
+// followed by the increment entry if the snapshot is an increment.
+func writeArchive(w io.Writer, snap *snapshot, codec dumpCodec) error {
+	archive := tar.NewWriter(w)
+	for _, kind := range recordKinds {
+		err := writeEntry(archive, string(kind)+".dump", snap.encode(kind), codec)
+		if err != nil {
+			return err
+		}
+	}
+
+	if snap.increment != nil {
+		err := writeEntry(archive, incrementFile, snap.increment.encode(snap.nextAccountID), codec)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// writeEntry - writes the file sealed by the codec to the tar archive.
+func writeEntry(archive *tar.Writer, name string, data []byte, codec dumpCodec) error {
+	data, err := codec.seal(data)
+	if err != nil {
+		return err
+	}
+
+	err = archive.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     int64(filePerm),
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = archive.Write(data)
+	return err
+}
+
+// readArchive - reads the dump files of the tar archive written by
+// writeArchive, the unknown files are skipped. The lines which can't
+// be read are returned as the errors, the broken archive or the increment
+// entry - as the error.
+func readArchive(r io.Reader, codec dumpCodec) (*snapshot, ImportErrors, error) {
+	snap := newSnapshot()
+	archive := tar.NewReader(r)
+
+	var errs ImportErrors
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if filepath.Base(header.Name) == incrementFile && snap.increment == nil {
+			data, err := io.ReadAll(archive)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ferr := snap.readIncrement(data, codec); ferr != nil {
+				return nil, nil, ferr
+			}
+			continue
+		}
+
+		kind := recordKind(strings.TrimSuffix(filepath.Base(header.Name), ".dump"))
+		if !isRecordKind(kind) || snap.found[kind] {
+			log.Printf("skipped %s", header.Name)
+			continue
+		}
+
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, nil, err
+		}
+		errs = append(errs, snap.read(kind, data, codec)...)
+	}
+	return snap, errs, nil
+}
+
+// fieldNames - the names of the fields of the dump lines, used in the errors.
+var fieldNames = map[recordKind][]string{
+	kindAccount:  {"id", "phone", "balance"},
+	kindPayment:  {"id", "account_id", "amount", "category", "status", "created", "updated"},
+	kindFavorite: {"id", "account_id", "name", "amount", "category", "created"},
+	kindTransfer: {"id", "from_account_id", "to_account_id", "amount", "status", "created", "updated"},
+	kindDeposit:  {"id", "account_id", "amount", "created"},
+	kindPosting:  {"id", "type", "reference", "created"},
+	kindKey:      {"key", "operation", "reference", "error", "created"},
+}
+
+// minFields - the number of fields every dump line of the kind must have,
+// the timestamps of payments, favorites and transfers are optional.
+var minFields = map[recordKind]int{
+	kindAccount:  3,
+	kindPayment:  5,
+	kindFavorite: 5,
+	kindTransfer: 5,
+	kindDeposit:  4,
+	kindPosting:  4,
+	kindKey:      5,
+}
+
+// fieldReader - reads the fields of a dump line, keeping the first error.
+type fieldReader struct {
+	kind   recordKind
+	fields []string
+	err    *ImportError
+}
+
+// name - returns the name of the field.
+func (r *fieldReader) name(i int) string {
+	names := fieldNames[r.kind]
+	if i < len(names) {
+		return names[i]
+	}
+	if r.kind == kindPosting {
+		return [...]string{"line_account", "line_debit", "line_credit"}[(i-len(names))%3]
+	}
+	return "field " + strconv.Itoa(i+1)
+}
+
+// str - returns the field as it is.
+func (r *fieldReader) str(i int) string {
+	return r.fields[i]
+}
+
+// int - returns the field as a number.
+func (r *fieldReader) int(i int) int64 {
+	value, err := strconv.ParseInt(r.fields[i], 10, 64)
+	if err != nil && r.err == nil {
+		r.err = &ImportError{
+			Field:  r.name(i),
+			Reason: fmt.Sprintf("%q is not a number", r.fields[i]),
+			Err:    err,
+		}
+	}
+	return value
+}
+
+// time - returns the field written by formatTime.
+func (r *fieldReader) time(i int) time.Time {
+	t, err := parseTime(r.fields[i])
+	if err != nil && r.err == nil {
+		r.err = &ImportError{
+			Field:  r.name(i),
+			Reason: fmt.Sprintf("%q is not a timestamp", r.fields[i]),
+			Err:    err,
+		}
+	}
+	return t
+}
+
+// decode - adds the record of the kind read from the fields of a dump line,
+// the line which can't be read is returned as the error without its position.
+func (snap *snapshot) decode(kind recordKind, fields []string) *ImportError {
+	if len(fields) < minFields[kind] {
+		return &ImportError{
+			Reason: fmt.Sprintf("expected at least %d fields, got %d", minFields[kind], len(fields)),
+			Err:    ErrMalformedRecord,
+		}
+	}
+	if kind == kindPosting && (len(fields)-4)%3 != 0 {
+		return &ImportError{
+			Reason: fmt.Sprintf("expected account, debit and credit for every line, got %d fields", len(fields)-4),
+			Err:    ErrMalformedRecord,
+		}
+	}
+
+	r := &fieldReader{kind: kind, fields: fields}
+	switch kind {
+	case kindAccount:
+		account := types.Account{
+			ID:      r.int(0),
+			Phone:   types.Phone(r.str(1)),
+			Balance: types.Money(r.int(2)),
+		}
+		if r.err == nil {
+			snap.accounts = append(snap.accounts, account)
+		}
+
+	case kindPayment:
+		payment := types.Payment{
+			ID:        r.str(0),
+			AccountID: r.int(1),
+			Amount:    types.Money(r.int(2)),
+			Category:  types.PaymentCategory(r.str(3)),
+			Status:    types.PaymentStatus(r.str(4)),
+		}
+		// dumps written before timestamps were added have no such fields.
+		if len(fields) > 6 {
+			payment.Created = r.time(5)
+			payment.Updated = r.time(6)
+		}
+		if r.err == nil {
+			snap.payments = append(snap.payments, payment)
+		}
+
+	case kindFavorite:
+		favorite := types.Favorite{
+			ID:        r.str(0),
+			AccountID: r.int(1),
+			Name:      r.str(2),
+			Amount:    types.Money(r.int(3)),
+			Category:  types.PaymentCategory(r.str(4)),
+		}
+		if len(fields) > 5 {
+			favorite.Created = r.time(5)
+		}
+		if r.err == nil {
+			snap.favorites = append(snap.favorites, favorite)
+		}
+
+	case kindTransfer:
+		transfer := types.Transfer{
+			ID:            r.str(0),
+			FromAccountID: r.int(1),
+			ToAccountID:   r.int(2),
+			Amount:        types.Money(r.int(3)),
+			Status:        types.PaymentStatus(r.str(4)),
+		}
+		if len(fields) > 6 {
+			transfer.Created = r.time(5)
+			transfer.Updated = r.time(6)
+		}
+		if r.err == nil {
+			snap.transfers = append(snap.transfers, transfer)
+		}
+
+	case kindDeposit:
+		deposit := types.Deposit{
+			ID:        r.str(0),
+			AccountID: r.int(1),
+			Amount:    types.Money(r.int(2)),
+			Created:   r.time(3),
+		}
+		if r.err == nil {
+			snap.deposits = append(snap.deposits, deposit)
+		}
+
+	case kindPosting:
+		posting := types.Posting{
+			ID:        r.str(0),
+			Type:      types.EntryType(r.str(1)),
+			Reference: r.str(2),
+			Created:   r.time(3),
+		}
+		for i := 4; i < len(fields); i += 3 {
+			posting.Lines = append(posting.Lines, types.Line{
+				Account: types.LedgerAccount(r.str(i)),
+				Debit:   types.Money(r.int(i + 1)),
+				Credit:  types.Money(r.int(i + 2)),
+			})
+		}
+		if r.err == nil {
+			snap.postings = append(snap.postings, posting)
+		}
+
+	case kindKey:
+		record := types.IdempotencyKey{
+			Key:       r.str(0),
+			Operation: r.str(1),
+			Reference: r.str(2),
+			Error:     r.str(3),
+			Created:   r.time(4),
+		}
+		if r.err == nil {
+			snap.keys = append(snap.keys, record)
+		}
+	}
+	return r.err
+}
+
+// formatAccount - the dump line of the account.
+func formatAccount(account types.Account) string {
+	return strconv.FormatInt(int64(account.ID), 10) + ";" +
+		escapeField(string(account.Phone)) + ";" +
+		strconv.FormatInt(int64(account.Balance), 10)
+}
+
+// formatPayment - the dump line of the payment.
+func formatPayment(payment types.Payment) string {
+	return escapeField(string(payment.ID)) + ";" +
+		strconv.FormatInt(int64(payment.AccountID), 10) + ";" +
+		strconv.FormatInt(int64(payment.Amount), 10) + ";" +
+		escapeField(string(payment.Category)) + ";" +
+		escapeField(string(payment.Status)) + ";" +
+		formatTime(payment.Created) + ";" +
+		formatTime(payment.Updated)
+}
+
+// formatFavorite - the dump line of the favorite.
+func formatFavorite(favorite types.Favorite) string {
+	return escapeField(string(favorite.ID)) + ";" +
+		strconv.FormatInt(int64(favorite.AccountID), 10) + ";" +
+		escapeField(string(favorite.Name)) + ";" +
+		strconv.FormatInt(int64(favorite.Amount), 10) + ";" +
+		escapeField(string(favorite.Category)) + ";" +
+		formatTime(favorite.Created)
+}
+
+// formatTransfer - the dump line of the transfer.
+func formatTransfer(transfer types.Transfer) string {
+	return escapeField(string(transfer.ID)) + ";" +
+		strconv.FormatInt(int64(transfer.FromAccountID), 10) + ";" +
+		strconv.FormatInt(int64(transfer.ToAccountID), 10) + ";" +
+		strconv.FormatInt(int64(transfer.Amount), 10) + ";" +
+		escapeField(string(transfer.Status)) + ";" +
+		formatTime(transfer.Created) + ";" +
+		formatTime(transfer.Updated)
+}
+
+// formatDeposit - the dump line of the deposit.
+func formatDeposit(deposit types.Deposit) string {
+	return escapeField(string(deposit.ID)) + ";" +
+		strconv.FormatInt(int64(deposit.AccountID), 10) + ";" +
+		strconv.FormatInt(int64(deposit.Amount), 10) + ";" +
+		formatTime(deposit.Created)
+}
+
+// formatPosting - the dump line of the posting: its fields followed
+// by the account, debit and credit of every line.
+func formatPosting(posting types.Posting) string {
+	text := escapeField(string(posting.ID)) + ";" +
+		escapeField(string(posting.Type)) + ";" +
+		escapeField(string(posting.Reference)) + ";" +
+		formatTime(posting.Created)
+	for _, line := range posting.Lines {
+		text += ";" + escapeField(string(line.Account)) + ";" +
+			strconv.FormatInt(int64(line.Debit), 10) + ";" +
+			strconv.FormatInt(int64(line.Credit), 10)
+	}
+	return text
+}
+
+// formatKey - the dump line of the idempotency key.
+func formatKey(record types.IdempotencyKey) string {
+	return escapeField(record.Key) + ";" +
+		escapeField(record.Operation) + ";" +
+		escapeField(record.Reference) + ";" +
+		escapeField(record.Error) + ";" +
+		formatTime(record.Created)
+}
+
+// formatTime - writes the time as unix nanoseconds, zero time as 0.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// parseTime - reads the time written by formatTime.
+func parseTime(text string) (time.Time, error) {
+	nsec, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || nsec == 0 {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nsec).UTC(), nil
+}
+
+// currentFile - the name of the file pointing to the current generation
+// of the dump directory written by Export.
+const currentFile = "CURRENT"
+
+// generationPrefix - the prefix of the generation directories.
+const generationPrefix = "gen-"
+
+// currentGeneration - returns the name of the current generation
+// of the directory, empty if it has none.
+func currentGeneration(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, currentFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// snapshotDir - returns the directory holding the dump files: the current
+// generation if there is one, the directory itself for the older dumps.
+func snapshotDir(dir string) (string, error) {
+	generation, err := currentGeneration(dir)
+	if err != nil || generation == "" {
+		return dir, err
+	}
+	return filepath.Join(dir, generation), nil
+}
+
+// generationLocks - the locks of the directories written by writeGeneration,
+// by their absolute paths.
+var generationLocks sync.Map
+
+// lockGeneration - locks the directory for writeGeneration and returns
+// the function unlocking it. The writers of the same directory take turns,
+// otherwise they would write the same generation and remove each other's.
+func lockGeneration(dir string) func() {
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		path = filepath.Clean(dir)
+	}
+
+	mu, _ := generationLocks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// writeGeneration - writes the snapshot to a new generation directory and
+// switches CURRENT to it, so the readers see either the old snapshot or
+// the new one as a whole. The files are sealed by the codec,
+// the older generations are removed, except the one CURRENT names.
+func writeGeneration(dir string, snap *snapshot, codec dumpCodec) error {
+	defer lockGeneration(dir)()
+
+	generation, err := currentGeneration(dir)
+	if err != nil {
+		return err
+	}
+
+	number, _ := strconv.Atoi(strings.TrimPrefix(generation, generationPrefix))
+	next := fmt.Sprintf("%s%06d", generationPrefix, number+1)
+	path := filepath.Join(dir, next)
+
+	// the leftovers of a failed attempt.
+	err = os.RemoveAll(path)
+	if err == nil {
+		err = os.Mkdir(path, dirPerm)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range recordKinds {
+		var data []byte
+		data, err = codec.seal(snap.encode(kind))
+		if err == nil {
+			err = writeFileSync(dumpPath(path, kind), data, filePerm)
+		}
+		if err != nil {
+			os.RemoveAll(path)
+			return err
+		}
+	}
+
+	err = syncDir(path)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(dir, currentFile), []byte(next+"\n"), filePerm)
+	}
+	if err != nil {
+		os.RemoveAll(path)
+		return err
+	}
+
+	// CURRENT is read again, it could be switched by another process.
+	current, err := currentGeneration(dir)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && strings.HasPrefix(name, generationPrefix) && name != next && name != current {
+			if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
+
+// writeFileSync - writes the data to the file and syncs it.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic - writes the data to a temporary file, syncs it and renames
+// it over the file, so the file has either the old data or the new one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	err := writeFileSync(tmp, data, perm)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir - syncs the directory, so the renames made in it survive a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// changes - returns the records of the snapshot as changes saving them.
+func (snap *snapshot) changes() []change {
+	changes := []change{}
+	for _, account := range snap.accounts {
+		changes = append(changes, change{kind: kindAccount, record: account})
+	}
+	for _, payment := range snap.payments {
+		changes = append(changes, change{kind: kindPayment, record: payment})
+	}
+	for _, favorite := range snap.favorites {
+		changes = append(changes, change{kind: kindFavorite, record: favorite})
+	}
+	for _, transfer := range snap.transfers {
+		changes = append(changes, change{kind: kindTransfer, record: transfer})
+	}
+	for _, deposit := range snap.deposits {
+		changes = append(changes, change{kind: kindDeposit, record: deposit})
+	}
+	for _, posting := range snap.postings {
+		changes = append(changes, change{kind: kindPosting, record: posting})
+	}
+	for _, record := range snap.keys {
+		changes = append(changes, change{kind: kindKey, record: record})
+	}
+	return changes
+}
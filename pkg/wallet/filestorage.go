@@ -0,0 +1,266 @@
+package wallet
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultSnapshotInterval - the number of commits after which the file
+// storage writes a new snapshot, unless another one is set.
+const DefaultSnapshotInterval = 1000
+
+// walFile - the name of the write-ahead log in the directory of the storage.
+const walFile = "wal.log"
+
+// stateFile - the name of the checkpoints of the storage(see encodeState),
+// written with the snapshot.
+const stateFile = "state.dump"
+
+// FileStorage - storage which keeps the data in memory and on disk.
+//
+// Every commit is appended to the write-ahead log of the directory and
+// synced before it is applied. From time to time the whole data is written
+// as a snapshot to the dump files(the same ones as Export) and the log is
+// cleared. On open the log is replayed on top of the last snapshot.
+//
+// The checkpoints of the incremental export and the checkpoint of the last
+// increment imported are kept the same way, so they stay valid when
+// the storage is reopened.
+type FileStorage struct {
+	*MemoryStorage
+	dir string
+
+	mu       sync.Mutex
+	wal      logFile
+	interval int
+	commits  int
+
+	// failed - the error which left the log in an unknown state,
+	// no commits are accepted after it.
+	failed error
+}
+
+// logFile - the file of the write-ahead log, *os.File.
+type logFile interface {
+	io.Writer
+	io.Seeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// OpenFileStorage - creates the directory if needed, loads the last snapshot
+// and replays the write-ahead log on top of it. The storage isn't opened
+// if any record of the snapshot can't be read, the records are returned
+// as ImportErrors then.
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	err := os.MkdirAll(dir, dirPerm)
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+
+	fs := &FileStorage{
+		MemoryStorage: NewMemoryStorage(),
+		dir:           dir,
+		interval:      DefaultSnapshotInterval,
+	}
+	snap, errs := readSnapshot(dir, dumpCodec{})
+	if errs != nil {
+		log.Print(errs)
+		return nil, errs
+	}
+	fs.apply(snap.changes())
+
+	// the new storage(or the one written before the state was added)
+	// writes the state of its new epoch before the log is replayed,
+	// so the log gives the same checkpoints on the next open.
+	path := filepath.Join(dir, stateFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = writeFileAtomic(path, fs.encodeState(), filePerm)
+	} else if err == nil {
+		if ferr := fs.restoreState(data); ferr != nil {
+			ferr.File = stateFile
+			err = ferr
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+
+	err = fs.recover()
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+	return fs, nil
+}
+
+// recover - replays the complete transactions of the log and cuts off
+// the one torn by a crash, then opens the log for appending.
+func (fs *FileStorage) recover() error {
+	path := filepath.Join(fs.dir, walFile)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	txs, valid, err := readLog(data)
+	if err != nil {
+		return err
+	}
+	for _, changes := range txs {
+		fs.apply(changes)
+	}
+	fs.commits = len(txs)
+
+	wal, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, filePerm)
+	if err != nil {
+		return err
+	}
+
+	if valid < len(data) {
+		log.Printf("%s: dropped %d bytes of an incomplete transaction", path, len(data)-valid)
+	}
+	err = wal.Truncate(int64(valid))
+	if err == nil {
+		_, err = wal.Seek(int64(valid), 0)
+	}
+	if err != nil {
+		wal.Close()
+		return err
+	}
+
+	fs.wal = wal
+	return nil
+}
+
+// Dir - returns the directory of the storage.
+func (fs *FileStorage) Dir() string {
+	return fs.dir
+}
+
+// SetSnapshotInterval - sets the number of commits after which a new
+// snapshot is written, zero or less disables the periodic snapshots.
+func (fs *FileStorage) SetSnapshotInterval(commits int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.interval = commits
+}
+
+// Begin - starts a new transaction, which is written to the log on commit.
+func (fs *FileStorage) Begin() Tx {
+	return &memoryTx{commit: fs.commit}
+}
+
+// commit - appends the changes to the log and applies them. The part of
+// the transaction written before a failure is cut off the log, so it's
+// neither replayed nor left in front of the next transactions; if it
+// can't be cut off, the storage fails with ErrStorageFailed.
+func (fs *FileStorage) commit(changes []change) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.failed != nil {
+		return fmt.Errorf("%w: %v", ErrStorageFailed, fs.failed)
+	}
+
+	offset, err := fs.wal.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = fs.wal.Write(encodeTx(changes))
+		if err == nil {
+			err = fs.wal.Sync()
+		}
+		if err != nil {
+			fs.cut(offset)
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	fs.apply(changes)
+
+	fs.commits++
+	if fs.interval > 0 && fs.commits >= fs.interval {
+		// the commit is already safe in the log, a failed snapshot
+		// only leaves the log longer.
+		if err := fs.snapshot(); err != nil {
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+// cut - cuts the log off at the offset, the storage fails if it can't.
+func (fs *FileStorage) cut(offset int64) {
+	err := fs.wal.Truncate(offset)
+	if err == nil {
+		_, err = fs.wal.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		err = fs.wal.Sync()
+	}
+	if err != nil {
+		log.Print(err)
+		fs.failed = err
+	}
+}
+
+// Snapshot - writes the whole data to the dump files and clears the log.
+func (fs *FileStorage) Snapshot() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.snapshot()
+}
+
+// snapshot - Snapshot without locking.
+func (fs *FileStorage) snapshot() error {
+	snap := takeSnapshot(fs.MemoryStorage)
+	for _, kind := range recordKinds {
+		err := writeFileAtomic(dumpPath(fs.dir, kind), snap.encode(kind), filePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the log isn't cleared yet, so it's replayed over the older state
+	// as well as over the new one: the records replayed over the new state
+	// are only exported by ExportIncrement once more.
+	err := writeFileAtomic(filepath.Join(fs.dir, stateFile), fs.encodeState(), filePerm)
+	if err != nil {
+		return err
+	}
+
+	// replaying the log over the new snapshot gives the same data,
+	// so a crash before the log is cleared loses nothing.
+	err = fs.wal.Truncate(0)
+	if err == nil {
+		_, err = fs.wal.Seek(0, 0)
+	}
+	if err == nil {
+		err = fs.wal.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	fs.commits = 0
+	return nil
+}
+
+// Close - closes the write-ahead log.
+func (fs *FileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.wal.Close()
+}
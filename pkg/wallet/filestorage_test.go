@@ -0,0 +1,386 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// openTestStorage - opens the file storage of the directory,
+// which is closed at the end of the test.
+func openTestStorage(t *testing.T, dir string) *FileStorage {
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStorage(): error = %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestFileStorage_reopen(t *testing.T) {
+	dir := t.TempDir()
+
+	s := &testService{Service: NewService(openTestStorage(t, dir))}
+	Transactions(s)
+
+	payment, err := s.Pay(1, 50, "food")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Confirm(payment.ID)
+	if err == nil {
+		payment, err = s.FindPaymentByID(payment.ID)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	reopened := NewService(openTestStorage(t, dir))
+
+	got, err := reopened.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Errorf("FindPaymentByID(): error = %v", err)
+		return
+	}
+	if !reflect.DeepEqual(got, payment) {
+		t.Errorf("OpenFileStorage(): wrong payment = %v, want %v", got, payment)
+	}
+
+	account, _ := reopened.FindAccountByID(1)
+	if account.Balance != 200 {
+		t.Errorf("OpenFileStorage(): wrong balance = %v", account)
+	}
+
+	if err := reopened.VerifyJournal(); err != nil {
+		t.Errorf("VerifyJournal(): error = %v", err)
+	}
+
+	account, err = reopened.RegisterAccount("+992000000999")
+	if err != nil {
+		t.Errorf("RegisterAccount(): error = %v", err)
+		return
+	}
+	if account.ID != 4 {
+		t.Errorf("RegisterAccount(): wrong ID after reopen = %v", account)
+	}
+}
+
+func TestFileStorage_recover_tornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	s := &testService{Service: NewService(openTestStorage(t, dir))}
+	Transactions(s)
+
+	path := filepath.Join(dir, walFile)
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the crash in the middle of the next commit.
+	torn := "payments;save;p1;1;10;food;INPROGRESS;0;0\naccounts;save;1;+992000000001;240\nCOMMIT;2;"
+	err = os.WriteFile(path, append(append([]byte{}, before...), torn...), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	reopened := NewService(openTestStorage(t, dir))
+
+	if _, err := reopened.FindPaymentByID("p1"); err != ErrPaymentNotFound {
+		t.Errorf("OpenFileStorage(): torn transaction was applied, error = %v", err)
+	}
+
+	account, _ := reopened.FindAccountByID(1)
+	if account.Balance != 250 {
+		t.Errorf("OpenFileStorage(): wrong balance = %v", account)
+	}
+
+	after, _ := os.ReadFile(path)
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("OpenFileStorage(): torn transaction wasn't cut off the log")
+	}
+}
+
+// failingLog - the log which writes a part of the data and fails
+// while it is broken, and fails the given number of syncs.
+type failingLog struct {
+	logFile
+	write bool
+	syncs int
+}
+
+// Write - writes the first half of the data when it's broken.
+func (l *failingLog) Write(data []byte) (int, error) {
+	if !l.write {
+		return l.logFile.Write(data)
+	}
+	n, _ := l.logFile.Write(data[:len(data)/2])
+	return n, errors.New("disk is full")
+}
+
+// Sync - fails while there are failing syncs left.
+func (l *failingLog) Sync() error {
+	if l.syncs > 0 {
+		l.syncs--
+		return errors.New("can't sync")
+	}
+	return l.logFile.Sync()
+}
+
+func TestFileStorage_commit_failed(t *testing.T) {
+	dir := t.TempDir()
+
+	storage := openTestStorage(t, dir)
+	s := &testService{Service: NewService(storage)}
+	Transactions(s)
+
+	wal := &failingLog{logFile: storage.wal}
+	storage.wal = wal
+
+	// the torn write.
+	wal.write = true
+	err := s.Deposit(1, 1000)
+	if err == nil {
+		t.Errorf("Deposit(): must return the error of the log")
+	}
+	wal.write = false
+
+	// the write which isn't synced.
+	wal.syncs = 1
+	err = s.Deposit(1, 1000)
+	if err == nil {
+		t.Errorf("Deposit(): must return the error of the log")
+	}
+
+	err = s.Deposit(1, 5)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	reopened := NewService(openTestStorage(t, dir))
+	account, err := reopened.FindAccountByID(1)
+	if err != nil || account.Balance != 255 {
+		t.Errorf("OpenFileStorage(): wrong account after the failed commits = %v, error = %v", account, err)
+	}
+}
+
+func TestFileStorage_commit_cutFails(t *testing.T) {
+	dir := t.TempDir()
+
+	storage := openTestStorage(t, dir)
+	s := &testService{Service: NewService(storage)}
+	Transactions(s)
+
+	// the log can't be synced at all.
+	storage.wal = &failingLog{logFile: storage.wal, syncs: 2}
+	err := s.Deposit(1, 5)
+	if err == nil {
+		t.Errorf("Deposit(): must return the error of the log")
+	}
+
+	storage.wal = storage.wal.(*failingLog).logFile
+	err = s.Deposit(1, 5)
+	if !errors.Is(err, ErrStorageFailed) {
+		t.Errorf("Deposit(): must return ErrStorageFailed, returned = %v", err)
+	}
+}
+
+func TestFileStorage_recover_badChecksum(t *testing.T) {
+	dir := t.TempDir()
+
+	s := &testService{Service: NewService(openTestStorage(t, dir))}
+	Transactions(s)
+
+	path := filepath.Join(dir, walFile)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	file.WriteString("accounts;save;1;+992000000001;240\nCOMMIT;1;12345\n")
+	file.Close()
+
+	reopened := NewService(openTestStorage(t, dir))
+
+	account, _ := reopened.FindAccountByID(1)
+	if account.Balance != 250 {
+		t.Errorf("OpenFileStorage(): transaction with bad checksum was applied = %v", account)
+	}
+}
+
+func TestFileStorage_badSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	storage := openTestStorage(t, dir)
+	s := &testService{Service: NewService(storage)}
+	Transactions(s)
+
+	err := storage.Snapshot()
+	if err != nil {
+		t.Errorf("Snapshot(): error = %v", err)
+		return
+	}
+
+	file, err := os.OpenFile(dumpPath(dir, kindAccount), os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	file.WriteString("x;+992000000009;0\n")
+	file.Close()
+
+	// the storage isn't opened with a part of the snapshot.
+	reopened, err := OpenFileStorage(dir)
+	var errs ImportErrors
+	if reopened != nil || !errors.As(err, &errs) || len(errs) != 1 {
+		t.Errorf("OpenFileStorage(): must return the bad record, returned = %v", err)
+	}
+
+	// nor with the checkpoints it can't read.
+	err = os.WriteFile(dumpPath(dir, kindAccount), nil, 0666)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, stateFile), []byte("storage;x\n"), 0666)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	reopened, err = OpenFileStorage(dir)
+	if reopened != nil || !errors.Is(err, ErrMalformedRecord) {
+		t.Errorf("OpenFileStorage(): must return ErrMalformedRecord for the bad state, returned = %v", err)
+	}
+}
+
+func TestFileStorage_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	storage := openTestStorage(t, dir)
+	storage.SetSnapshotInterval(0)
+
+	s := &testService{Service: NewService(storage)}
+	Transactions(s)
+
+	err := storage.Snapshot()
+	if err != nil {
+		t.Errorf("Snapshot(): error = %v", err)
+		return
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, walFile)); err != nil || info.Size() != 0 {
+		t.Errorf("Snapshot(): the log wasn't cleared, info = %v, error = %v", info, err)
+	}
+
+	// changes after the snapshot go to the log only.
+	_, err = s.Transfer(1, 2, 50)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	reopened := NewService(openTestStorage(t, dir))
+	for id, want := range map[int64]int64{1: 200, 2: 210, 3: 227} {
+		account, err := reopened.FindAccountByID(id)
+		if err != nil || int64(account.Balance) != want {
+			t.Errorf("OpenFileStorage(): wrong account = %v, error = %v, want balance %v", account, err, want)
+		}
+	}
+
+	if report := reopened.Verify(); !report.OK() {
+		t.Errorf("Verify(): issues after recovery = %v", report.Issues)
+	}
+}
+
+func TestFileStorage_periodicSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	storage := openTestStorage(t, dir)
+	storage.SetSnapshotInterval(2)
+
+	s := NewService(storage)
+	s.RegisterAccount("+992000000001")
+	s.Deposit(1, 100)
+
+	if info, err := os.Stat(filepath.Join(dir, walFile)); err != nil || info.Size() != 0 {
+		t.Errorf("commit(): no snapshot after the interval, info = %v, error = %v", info, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "accounts.dump"))
+	if err != nil || !strings.Contains(string(data), "\n1;+992000000001;100\n") {
+		t.Errorf("commit(): wrong snapshot = %q, error = %v", data, err)
+	}
+}
+
+func TestFileStorage_reopen_increments(t *testing.T) {
+	dir := t.TempDir()
+	importerDir := t.TempDir()
+
+	for _, snapshot := range []bool{false, true} {
+		s := &testService{Service: NewService(openTestStorage(t, dir))}
+		importer := NewService(openTestStorage(t, importerDir))
+		Transactions(s)
+
+		base := &bytes.Buffer{}
+		checkpoint, err := s.ExportIncrement(base, "")
+		if err == nil {
+			err = importer.ImportIncrement(base)
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if snapshot {
+			for _, storage := range []Storage{s.store(), importer.store()} {
+				if err := storage.(*FileStorage).Snapshot(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+
+		// both services are restarted, the chain goes on.
+		s = &testService{Service: NewService(openTestStorage(t, dir))}
+		importer = NewService(openTestStorage(t, importerDir))
+
+		payment, err := s.Pay(2, 20, "rent")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		next := &bytes.Buffer{}
+		_, err = s.ExportIncrement(next, checkpoint)
+		if err != nil {
+			t.Errorf("ExportIncrement(%v): checkpoint of the reopened storage = %v", snapshot, err)
+			return
+		}
+
+		snap, _, err := readArchive(bytes.NewReader(next.Bytes()), dumpCodec{})
+		if err != nil || len(snap.payments) != 1 || snap.payments[0].ID != payment.ID {
+			t.Errorf("ExportIncrement(%v): wrong increment, error = %v", snapshot, err)
+		}
+
+		err = importer.ImportIncrement(next)
+		if err != nil {
+			t.Errorf("ImportIncrement(%v): increment after the reopen = %v", snapshot, err)
+			return
+		}
+
+		if !reflect.DeepEqual(takeSnapshot(importer.store()), takeSnapshot(s.store())) {
+			t.Errorf("ImportIncrement(%v): wrong records imported", snapshot)
+		}
+
+		dir, importerDir = t.TempDir(), t.TempDir()
+	}
+}
@@ -0,0 +1,245 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DumpVersion - the version of the dump files written by the service.
+//
+// Version 1 - the legacy files without header and checksum, whose payments,
+// transfers and favorites may have no timestamps.
+// Version 2 - the header and the checksum are added, every record has
+// all of its fields.
+// Version 3 - the backslashes, separators and line breaks inside
+// the fields are escaped(see escapeField).
+//
+// The dump file of version 2 and later looks like:
+//
+//	#dump;<version>;<number of records>
+//	<record>
+//	...
+//	#sha256;<hex of the SHA-256 of all lines above>
+const DumpVersion = 3
+
+// Prefixes of the header and the trailer lines.
+const (
+	dumpHeader  = "#dump"
+	dumpTrailer = "#sha256"
+)
+
+// dumpLine - the record line of the dump file with its number in the file.
+type dumpLine struct {
+	number int
+	text   string
+}
+
+// encodeDump - returns the dump file of the current version with the records.
+func encodeDump(records []string) []byte {
+	var buf bytes.Buffer
+	writeDump(&buf, records)
+	return buf.Bytes()
+}
+
+// writeDump - writes the dump file of the current version with the records,
+// the checksum is counted while the records are written.
+func writeDump(w io.Writer, records []string) error {
+	hash := sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(w, hash))
+	buf.WriteString(dumpHeader + ";" + strconv.Itoa(DumpVersion) + ";" + strconv.Itoa(len(records)) + "\n")
+	for _, record := range records {
+		buf.WriteString(record + "\n")
+	}
+
+	err := buf.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, dumpTrailer+";"+hex.EncodeToString(hash.Sum(nil))+"\n")
+	return err
+}
+
+// decodeDump - returns the record lines and the version of the dump file.
+// The header, the number of records and the checksum are verified,
+// the file which fails it is returned as the error without the file name.
+func decodeDump(data []byte) ([]dumpLine, int, *ImportError) {
+	text := string(data)
+	if !strings.HasPrefix(text, dumpHeader+";") {
+		return splitLines(text, 1), 1, nil
+	}
+
+	end := strings.IndexByte(text, '\n')
+	if end < 0 {
+		return nil, 0, &ImportError{Line: 1, Reason: "header without records", Err: ErrChecksumMismatch}
+	}
+
+	header := strings.Split(strings.TrimSuffix(text[:end], "\r"), ";")
+	if len(header) != 3 {
+		return nil, 0, &ImportError{Line: 1, Reason: fmt.Sprintf("bad header %q", text[:end]), Err: ErrMalformedRecord}
+	}
+
+	version, err := strconv.Atoi(header[1])
+	if err != nil || version < 2 || version > DumpVersion {
+		return nil, 0, &ImportError{Line: 1, Field: "version", Reason: fmt.Sprintf("version %q is not supported", header[1]), Err: ErrUnsupportedVersion}
+	}
+
+	count, err := strconv.Atoi(header[2])
+	if err != nil {
+		return nil, 0, &ImportError{Line: 1, Field: "records", Reason: fmt.Sprintf("%q is not a number", header[2]), Err: ErrMalformedRecord}
+	}
+
+	// the trailer is the last line of the file.
+	body := strings.TrimRight(text, "\r\n")
+	start := strings.LastIndexByte(body, '\n') + 1
+	trailer := strings.Split(strings.TrimSuffix(body[start:], "\r"), ";")
+	if len(trailer) != 2 || trailer[0] != dumpTrailer {
+		return nil, 0, &ImportError{Reason: "checksum is missing, the file is cut", Err: ErrChecksumMismatch}
+	}
+
+	sum := sha256.Sum256([]byte(text[:start]))
+	if hex.EncodeToString(sum[:]) != trailer[1] {
+		return nil, 0, &ImportError{Reason: "checksum doesn't match the content", Err: ErrChecksumMismatch}
+	}
+
+	lines := splitLines(text[end+1:start], 2)
+	if len(lines) != count {
+		return nil, 0, &ImportError{Line: 1, Field: "records", Reason: fmt.Sprintf("header says %d records, found %d", count, len(lines)), Err: ErrChecksumMismatch}
+	}
+	return lines, version, nil
+}
+
+// splitLines - returns the non-empty lines of the text numbered from first.
+func splitLines(text string, first int) []dumpLine {
+	lines := []dumpLine{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, dumpLine{number: first + i, text: line})
+	}
+	return lines
+}
+
+// migrations - upgrade the fields of the record of the version to the next one.
+var migrations = map[int]func(kind recordKind, fields []string) []string{
+	1: migrateV1,
+	// the records of version 3 differ only in the escaping,
+	// which is already undone by splitFields.
+	2: func(kind recordKind, fields []string) []string { return fields },
+}
+
+// migrate - upgrades the fields of the record of the version to the current one.
+func migrate(kind recordKind, version int, fields []string) []string {
+	for ; version < DumpVersion; version++ {
+		fields = migrations[version](kind, fields)
+	}
+	return fields
+}
+
+// migrateV1 - adds the zero timestamps to the records written before
+// the timestamps were added.
+func migrateV1(kind recordKind, fields []string) []string {
+	size := 0
+	switch kind {
+	case kindPayment, kindTransfer:
+		size = 7
+	case kindFavorite:
+		size = 6
+	}
+
+	// the records with a part of the timestamps are left as they are.
+	if len(fields) != minFields[kind] || size == 0 {
+		return fields
+	}
+	for len(fields) < size {
+		fields = append(fields, "0")
+	}
+	return fields
+}
+
+// fieldEscaper - escapes the characters which can't appear in a field as they are.
+var fieldEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	"|", `\|`,
+	"\n", `\n`,
+	"\r", `\r`,
+)
+
+// escapeField - escapes the backslashes, the separators of the fields(;)
+// and of the records of ExportToFile(|) and the line breaks of the field,
+// so every record stays on its own line.
+func escapeField(field string) string {
+	return fieldEscaper.Replace(field)
+}
+
+// unescapeField - undoes escapeField, an unknown escape is kept as the
+// escaped character.
+func unescapeField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' || i == len(field)-1 {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch field[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(field[i])
+		}
+	}
+	return b.String()
+}
+
+// splitEscaped - splits the text at the separators which are not escaped,
+// the parts are left escaped.
+func splitEscaped(text string, sep byte) []string {
+	parts := []string{}
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, text[start:])
+}
+
+// splitRecord - splits the record into the unescaped fields.
+func splitRecord(record string, sep byte) []string {
+	fields := splitEscaped(record, sep)
+	for i, field := range fields {
+		fields[i] = unescapeField(field)
+	}
+	return fields
+}
+
+// splitFields - splits the dump line of the version into the fields,
+// the lines written before version 3 are not escaped.
+func splitFields(version int, line string) []string {
+	if version < 3 {
+		return strings.Split(line, ";")
+	}
+	return splitRecord(line, ';')
+}
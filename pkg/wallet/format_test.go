@@ -0,0 +1,308 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+func TestDecodeDump_roundTrip(t *testing.T) {
+	records := []string{"1;+1111;400", "2;+2222;0"}
+	lines, version, err := decodeDump(encodeDump(records))
+	if err != nil {
+		t.Errorf("decodeDump(): error = %v", err)
+		return
+	}
+
+	want := []dumpLine{{number: 2, text: records[0]}, {number: 3, text: records[1]}}
+	if version != DumpVersion || !reflect.DeepEqual(lines, want) {
+		t.Errorf("decodeDump(): wrong lines = %v, version = %v", lines, version)
+	}
+}
+
+func TestDecodeDump_legacy(t *testing.T) {
+	lines, version, err := decodeDump([]byte("1;+1111;400\n\n2;+2222;0"))
+	if err != nil {
+		t.Errorf("decodeDump(): error = %v", err)
+		return
+	}
+
+	want := []dumpLine{{number: 1, text: "1;+1111;400"}, {number: 3, text: "2;+2222;0"}}
+	if version != 1 || !reflect.DeepEqual(lines, want) {
+		t.Errorf("decodeDump(): wrong lines = %v, version = %v", lines, version)
+	}
+}
+
+func TestDecodeDump_corrupted(t *testing.T) {
+	valid := string(encodeDump([]string{"1;+1111;400", "2;+2222;0"}))
+
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"changed", strings.Replace(valid, "400", "900", 1), ErrChecksumMismatch},
+		{"cut", valid[:len(valid)-80], ErrChecksumMismatch},
+		{"headerOnly", "#dump;2;0", ErrChecksumMismatch},
+		{"badHeader", "#dump;2\n#sha256;00\n", ErrMalformedRecord},
+		{"newerVersion", "#dump;99;0\n#sha256;00\n", ErrUnsupportedVersion},
+	}
+
+	for _, tt := range tests {
+		_, _, err := decodeDump([]byte(tt.data))
+		if err == nil || !errors.Is(err, tt.want) {
+			t.Errorf("decodeDump(%s): must return %v, returned = %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestDecodeDump_wrongCount(t *testing.T) {
+	// the checksum is right, the header is not.
+	body := "#dump;2;3\n1;+1111;400\n2;+2222;0\n"
+	sum := sha256.Sum256([]byte(body))
+	data := body + "#sha256;" + hex.EncodeToString(sum[:]) + "\n"
+
+	_, _, err := decodeDump([]byte(data))
+	if err == nil || !errors.Is(err, ErrChecksumMismatch) || err.Field != "records" {
+		t.Errorf("decodeDump(): must return error for the wrong number of records, returned = %v", err)
+	}
+}
+
+func TestMigrate_v1(t *testing.T) {
+	tests := []struct {
+		kind   recordKind
+		fields []string
+		want   []string
+	}{
+		{kindPayment, []string{"p1", "1", "100", "auto", "OK"}, []string{"p1", "1", "100", "auto", "OK", "0", "0"}},
+		{kindTransfer, []string{"t1", "1", "2", "100", "OK"}, []string{"t1", "1", "2", "100", "OK", "0", "0"}},
+		{kindFavorite, []string{"f1", "1", "name", "100", "auto"}, []string{"f1", "1", "name", "100", "auto", "0"}},
+		{kindAccount, []string{"1", "+1111", "400"}, []string{"1", "+1111", "400"}},
+		{kindPayment, []string{"p1", "1"}, []string{"p1", "1"}},
+	}
+
+	for _, tt := range tests {
+		got := migrate(tt.kind, 1, tt.fields)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("migrate(%s): wrong fields = %v, want = %v", tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestService_Import_corruptedFile(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	path, _ := snapshotDir(dir)
+	data, err := os.ReadFile(path + "/payments.dump")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = os.WriteFile(path+"/payments.dump", []byte(strings.Replace(string(data), ";food;", ";bank;", 1)), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	strict := newTestService()
+	strict.SetImportMode(ImportStrict)
+	err = strict.Import(dir)
+	if !errors.Is(err, ErrChecksumMismatch) || !strings.Contains(err.Error(), "payments.dump") {
+		t.Errorf("Import(): must return ErrChecksumMismatch for payments.dump, returned = %v", err)
+	}
+	if accounts := strict.store().Accounts(); len(accounts) != 0 {
+		t.Errorf("Import(): service changed in strict mode, accounts = %v", accounts)
+	}
+
+	// the lenient import skips the whole corrupted file.
+	lenient := newTestService()
+	err = lenient.Import(dir)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Import(): must return ErrChecksumMismatch, returned = %v", err)
+	}
+	if len(lenient.store().Accounts()) != 3 || len(lenient.store().Payments()) != 0 {
+		t.Errorf("Import(): wrong data imported, accounts = %v, payments = %v",
+			lenient.store().Accounts(), lenient.store().Payments())
+	}
+}
+
+func TestService_Import_legacyMigrated(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"accounts.dump":  "1;+1111;400\n",
+		"payments.dump":  "p1;1;100;auto;INPROGRESS\n",
+		"favorites.dump": "f1;1;my auto;100;auto\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(dir+"/"+name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newTestService()
+	s.SetImportMode(ImportStrict)
+	err := s.Import(dir)
+	if err != nil {
+		t.Errorf("Import(): error = %v", err)
+		return
+	}
+
+	payment, err := s.FindPaymentByID("p1")
+	if err != nil || !payment.Created.IsZero() || payment.Amount != 100 {
+		t.Errorf("Import(): wrong payment = %v, error = %v", payment, err)
+	}
+
+	// the next export writes the current version.
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	path, _ := snapshotDir(dir)
+	data, _ := os.ReadFile(path + "/favorites.dump")
+	if !strings.HasPrefix(string(data), "#dump;"+strconv.Itoa(DumpVersion)+";1\nf1;1;my auto;100;auto;0\n") {
+		t.Errorf("Export(): wrong favorites = %q", data)
+	}
+}
+
+// trickyNames - the names which broke the dump before the escaping.
+var trickyNames = []string{"rent; March", "line\nbreak", "crlf\r\n", `back\slash`, `\;`, "pipe|name", "", ";", "\\", "\\n"}
+
+func TestSplitRecord_quick(t *testing.T) {
+	roundTrip := func(a, b, c string) bool {
+		record := escapeField(a) + ";" + escapeField(b) + ";" + escapeField(c)
+		return !strings.ContainsAny(record, "\r\n") &&
+			reflect.DeepEqual(splitRecord(record, ';'), []string{a, b, c})
+	}
+
+	for _, name := range trickyNames {
+		if !roundTrip(name, name, "x") {
+			t.Errorf("splitRecord(): wrong round trip of %q", name)
+		}
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestService_Export_quick(t *testing.T) {
+	roundTrip := func(name string, category types.PaymentCategory) bool {
+		s := newTestService()
+		s.RegisterAccount("+1111")
+		s.Deposit(1, 100)
+		payment, err := s.Pay(1, 10, category)
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		favorite, err := s.FavoritePayment(payment.ID, name)
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		dir := t.TempDir()
+		if err := s.Export(dir); err != nil {
+			t.Error(err)
+			return false
+		}
+
+		imported := newTestService()
+		imported.SetImportMode(ImportStrict)
+		if err := imported.Import(dir); err != nil {
+			t.Error(err)
+			return false
+		}
+
+		gotPayment, err1 := imported.FindPaymentByID(payment.ID)
+		gotFavorite, err2 := imported.FindFavoriteByID(favorite.ID)
+		return err1 == nil && err2 == nil &&
+			reflect.DeepEqual(gotPayment, payment) && reflect.DeepEqual(gotFavorite, favorite)
+	}
+
+	for _, name := range trickyNames {
+		if !roundTrip(name, types.PaymentCategory(name)) {
+			t.Errorf("Export(): wrong round trip of %q", name)
+		}
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 30}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestService_ExportToFile_quick(t *testing.T) {
+	roundTrip := func(first, second types.Phone) bool {
+		if first == second {
+			return true
+		}
+
+		s := newTestService()
+		s.RegisterAccount(first)
+		s.RegisterAccount(second)
+		s.Deposit(2, 10)
+
+		path := t.TempDir() + "/accounts.txt"
+		if err := s.ExportToFile(path); err != nil {
+			t.Error(err)
+			return false
+		}
+
+		imported := newTestService()
+		imported.SetImportMode(ImportStrict)
+		if err := imported.ImportFromFile(path); err != nil {
+			t.Error(err)
+			return false
+		}
+
+		accounts := []types.Account{}
+		for _, account := range imported.store().Accounts() {
+			accounts = append(accounts, *account)
+		}
+		return reflect.DeepEqual(accounts, []types.Account{{ID: 1, Phone: first}, {ID: 2, Phone: second, Balance: 10}})
+	}
+
+	for _, name := range trickyNames {
+		if !roundTrip(types.Phone(name), "+2222") {
+			t.Errorf("ExportToFile(): wrong round trip of %q", name)
+		}
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 30}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeChange_quick(t *testing.T) {
+	roundTrip := func(name string, category types.PaymentCategory, id string) bool {
+		saved := change{kind: kindFavorite, record: types.Favorite{ID: id, AccountID: 1, Name: name, Amount: 5, Category: category}}
+		deleted := change{kind: kindPayment, delete: true, record: id}
+
+		for _, c := range []change{saved, deleted} {
+			got, err := decodeChange(encodeChange(c))
+			if err != nil || !reflect.DeepEqual(got, c) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,499 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// manifestFile - the name of the manifest written by HistoryToFiles.
+//
+// The manifest is the dump file whose records list the shards
+// in the order they were written:
+//
+//	<name of the shard>;<number of payments>;<hex of the SHA-256 of the file>
+const manifestFile = "manifest.dump"
+
+// RotationPeriod - the calendar period of the payments of one history file.
+type RotationPeriod int
+
+// Predefined rotation periods, the payments are put to the periods
+// by the time they were created(in UTC).
+const (
+	RotateNone RotationPeriod = iota
+	RotateDay
+	RotateMonth
+)
+
+// Rotation - how HistoryToFilesBy splits the payments into the files.
+//
+// The payments are grouped by the account and(or) the period first,
+// then every group is split into the files of at most Records payments
+// and(or) at most MaxSize bytes of the records(the header, the checksum,
+// the compression and the encryption are not counted; a record longer
+// than MaxSize gets a file of its own). The zero limits are not applied.
+//
+// The file of the group is named payments-account<ID>-<period>.dump
+// (payments.dump without any grouping), the period is written as
+// 2006-01-02 or 2006-01. The files of the group split in several
+// are numbered from 1: payments-2006-01-1.dump, payments-2006-01-2.dump
+// (payments1.dump, payments2.dump without any grouping).
+type Rotation struct {
+	Period    RotationPeriod
+	ByAccount bool
+	Records   int
+	MaxSize   int64
+}
+
+// validate - returns the error for the nonsensical rotation.
+func (r Rotation) validate() error {
+	switch {
+	case r.Period < RotateNone || r.Period > RotateMonth:
+		return fmt.Errorf("%w: unknown period %d", ErrInvalidRotation, r.Period)
+	case r.Records < 0:
+		return fmt.Errorf("%w: %d records per file", ErrInvalidRotation, r.Records)
+	case r.MaxSize < 0:
+		return fmt.Errorf("%w: %d bytes per file", ErrInvalidRotation, r.MaxSize)
+	}
+	return nil
+}
+
+// HistoryToFilesBy - writes the payments to the files of the directory
+// split as set by the rotation, with the manifest of the files.
+//
+// The shards written to the directory before(the ones of the previous
+// manifest, or found by the names without it) which are not written
+// again are removed after the new manifest, so the directory has
+// only the shards of the new one(none, if there are no payments).
+func (s *Service) HistoryToFilesBy(payments []types.Payment, dir string, rotation Rotation) error {
+	err := rotation.validate()
+	if err != nil {
+		return err
+	}
+
+	_, cerr := os.Stat(dir)
+	if os.IsNotExist(cerr) {
+		cerr = os.Mkdir(dir, dirPerm)
+	}
+	if cerr != nil {
+		return cerr
+	}
+
+	// the shards of the damaged manifest are left as they are.
+	previous, err := s.historyShards(dir)
+	if err != nil {
+		log.Print(err)
+	}
+
+	written := map[string]bool{}
+	err = s.HistoryToWritersBy(payments, rotation, func(name string) (io.WriteCloser, error) {
+		written[name] = true
+		return os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, filePerm)
+	})
+	if err != nil || !written[manifestFile] {
+		return err
+	}
+
+	for _, shard := range previous {
+		if written[shard.name] {
+			continue
+		}
+		err := os.Remove(filepath.Join(dir, shard.name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+// historyShards - returns the shards of the history directory listed
+// in its manifest, or found by the names if there is none.
+func (s *Service) historyShards(dir string) ([]historyShard, error) {
+	s.mu.RLock()
+	codec := s.codec
+	s.mu.RUnlock()
+
+	shards, err := readManifest(func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, name))
+	}, codec)
+	if !errors.Is(err, os.ErrNotExist) {
+		return shards, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return findShards(entries), nil
+}
+
+// HistoryToWritersBy - writes the payments the same way as HistoryToFilesBy
+// to the writers opened by create.
+func (s *Service) HistoryToWritersBy(payments []types.Payment, rotation Rotation, create func(name string) (io.WriteCloser, error)) error {
+	err := rotation.validate()
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// no payments make the empty manifest, which replaces the older one.
+	shards := []historyShard{}
+	for _, file := range splitHistory(payments, rotation) {
+		shard, err := writeHistory(create, s.codec, file.name, file.records)
+		if err != nil {
+			log.Print(err)
+			return err
+		}
+		shards = append(shards, shard)
+	}
+
+	// the manifest is written last, so it lists only the complete shards.
+	err = writeManifest(create, s.codec, shards)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	return nil
+}
+
+// historyFile - the name and the records of the file of the history.
+type historyFile struct {
+	name    string
+	records []string
+}
+
+// historyKey - the account and(or) the period of the group of payments.
+type historyKey struct {
+	accountID int64
+	period    string
+}
+
+// historyGroup - the payments of the account and(or) the period.
+type historyGroup struct {
+	historyKey
+	records []string
+}
+
+// splitHistory - returns the files of the payments split by the rotation.
+// The groups go in the order of the accounts and the periods, the payments
+// of the group keep their order.
+func splitHistory(payments []types.Payment, rotation Rotation) []historyFile {
+	groups := []*historyGroup{}
+	index := map[historyKey]*historyGroup{}
+	for _, payment := range payments {
+		key := historyKey{}
+		if rotation.ByAccount {
+			key.accountID = payment.AccountID
+		}
+		switch rotation.Period {
+		case RotateDay:
+			key.period = payment.Created.UTC().Format("2006-01-02")
+		case RotateMonth:
+			key.period = payment.Created.UTC().Format("2006-01")
+		}
+
+		group, ok := index[key]
+		if !ok {
+			group = &historyGroup{historyKey: key}
+			index[key] = group
+			groups = append(groups, group)
+		}
+		group.records = append(group.records, formatPayment(payment))
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].accountID != groups[j].accountID {
+			return groups[i].accountID < groups[j].accountID
+		}
+		return groups[i].period < groups[j].period
+	})
+
+	files := []historyFile{}
+	for _, group := range groups {
+		name := "payments"
+		if rotation.ByAccount {
+			name += "-account" + strconv.FormatInt(group.accountID, 10)
+		}
+		if group.period != "" {
+			name += "-" + group.period
+		}
+
+		chunks := splitRecords(group.records, rotation)
+		for i, records := range chunks {
+			file := historyFile{name: name + ".dump", records: records}
+			if len(chunks) > 1 && name == "payments" {
+				file.name = name + strconv.Itoa(i+1) + ".dump"
+			} else if len(chunks) > 1 {
+				file.name = name + "-" + strconv.Itoa(i+1) + ".dump"
+			}
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// splitRecords - splits the records by the limits of the rotation.
+func splitRecords(records []string, rotation Rotation) [][]string {
+	chunks := [][]string{}
+	var chunk []string
+	var size int64
+	for _, record := range records {
+		full := rotation.Records > 0 && len(chunk) == rotation.Records ||
+			rotation.MaxSize > 0 && len(chunk) > 0 && size+int64(len(record))+1 > rotation.MaxSize
+		if full {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+
+		chunk = append(chunk, record)
+		size += int64(len(record)) + 1
+	}
+	return append(chunks, chunk)
+}
+
+// historyShard - the entry of the manifest. The shards found without
+// the manifest have no count(-1) and no checksum.
+type historyShard struct {
+	name    string
+	records int
+	sum     string
+}
+
+// writeManifest - writes the manifest of the shards to the writer
+// opened by create.
+func writeManifest(create func(name string) (io.WriteCloser, error), codec dumpCodec, shards []historyShard) error {
+	records := []string{}
+	for _, shard := range shards {
+		records = append(records, escapeField(shard.name)+";"+strconv.Itoa(shard.records)+";"+shard.sum)
+	}
+
+	_, err := writeHistory(create, codec, manifestFile, records)
+	return err
+}
+
+// readManifest - reads the manifest opened by open.
+func readManifest(open func(name string) (io.ReadCloser, error), codec dumpCodec) ([]historyShard, error) {
+	data, err := readAll(open, manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ferr := codec.open(data)
+	if ferr == nil {
+		var lines []dumpLine
+		var version int
+		lines, version, ferr = decodeDump(data)
+
+		shards := []historyShard{}
+		for _, line := range lines {
+			fields := splitFields(version, line.text)
+			if len(fields) != 3 {
+				ferr = &ImportError{Line: line.number, Reason: fmt.Sprintf("expected 3 fields, got %d", len(fields)), Err: ErrMalformedRecord}
+				break
+			}
+
+			if !isShardName(fields[0]) {
+				ferr = &ImportError{Line: line.number, Field: "name", Reason: fmt.Sprintf("%q is not a name of the shard", fields[0]), Err: ErrMalformedRecord}
+				break
+			}
+
+			records, err := strconv.Atoi(fields[1])
+			if err != nil || records < 0 {
+				ferr = &ImportError{Line: line.number, Field: "records", Reason: fmt.Sprintf("%q is not a number", fields[1]), Err: ErrMalformedRecord}
+				break
+			}
+			shards = append(shards, historyShard{name: fields[0], records: records, sum: fields[2]})
+		}
+
+		if ferr == nil {
+			return shards, nil
+		}
+	}
+
+	ferr.File = manifestFile
+	return nil, ferr
+}
+
+// isShardName - reports whether the name is the one HistoryToFilesBy gives
+// to the shards: payments*.dump in the directory itself, the names of the
+// manifest are opened and removed in the directory.
+func isShardName(name string) bool {
+	return filepath.Base(name) == name && !strings.ContainsAny(name, `/\`) &&
+		strings.HasPrefix(name, "payments") && strings.HasSuffix(name, ".dump")
+}
+
+// readAll - reads the whole file opened by open.
+func readAll(open func(name string) (io.ReadCloser, error), name string) ([]byte, error) {
+	r, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	return data, err
+}
+
+// readShards - reads the payments of the shards in their order. The shards
+// which are missing or don't match the manifest are skipped, as well as
+// the lines which can't be read, and returned as the errors.
+func readShards(open func(name string) (io.ReadCloser, error), codec dumpCodec, shards []historyShard) ([]types.Payment, ImportErrors) {
+	payments := []types.Payment{}
+	var errs ImportErrors
+	for _, shard := range shards {
+		data, err := readAll(open, shard.name)
+		if errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, &ImportError{File: shard.name, Reason: "listed in the manifest, but missing", Err: ErrShardMissing})
+			continue
+		}
+		if err != nil {
+			errs = append(errs, &ImportError{File: shard.name, Reason: err.Error(), Err: err})
+			continue
+		}
+
+		sum := sha256.Sum256(data)
+		if shard.sum != "" && hex.EncodeToString(sum[:]) != shard.sum {
+			errs = append(errs, &ImportError{File: shard.name, Reason: "checksum doesn't match the manifest", Err: ErrChecksumMismatch})
+			continue
+		}
+
+		snap := newSnapshot()
+		ferrs := snap.read(kindPayment, data, codec)
+		for _, err := range ferrs {
+			err.File = shard.name
+		}
+		errs = append(errs, ferrs...)
+
+		if ferrs == nil && shard.records >= 0 && len(snap.payments) != shard.records {
+			errs = append(errs, &ImportError{
+				File:   shard.name,
+				Reason: fmt.Sprintf("manifest says %d records, found %d", shard.records, len(snap.payments)),
+				Err:    ErrChecksumMismatch,
+			})
+			continue
+		}
+		payments = append(payments, snap.payments...)
+	}
+	return payments, errs
+}
+
+// HistoryFromFiles - reads back the payments written by HistoryToFiles
+// in the order they were written.
+//
+// The shards are taken from the manifest, the ones which are missing,
+// damaged or not listed in it are reported as ImportErrors. The directories
+// written before the manifest was added are read by the names of the shards.
+// In the lenient mode the payments of the good shards are returned
+// together with the errors, in the strict mode - none of them.
+func (s *Service) HistoryFromFiles(dir string) ([]types.Payment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	open := func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, name))
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+
+	shards, err := readManifest(open, s.codec)
+	var errs ImportErrors
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		shards = findShards(entries)
+	case err != nil:
+		log.Print(err)
+		return nil, err
+	default:
+		listed := map[string]bool{}
+		for _, shard := range shards {
+			listed[shard.name] = true
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.Type().IsRegular() && strings.HasSuffix(name, ".dump") && name != manifestFile && !listed[name] {
+				errs = append(errs, &ImportError{File: name, Reason: "not listed in the manifest", Err: ErrShardUnexpected})
+			}
+		}
+	}
+
+	payments, rerrs := readShards(open, s.codec, shards)
+	return s.historyResult(payments, append(errs, rerrs...))
+}
+
+// HistoryFromReaders - reads back the payments written by HistoryToWriters,
+// the files are opened by open with their names. The manifest is required,
+// otherwise it is the same as HistoryFromFiles.
+func (s *Service) HistoryFromReaders(open func(name string) (io.ReadCloser, error)) ([]types.Payment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	shards, err := readManifest(open, s.codec)
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+
+	payments, errs := readShards(open, s.codec, shards)
+	return s.historyResult(payments, errs)
+}
+
+// historyResult - returns the payments read and the errors
+// according to the import mode.
+func (s *Service) historyResult(payments []types.Payment, errs ImportErrors) ([]types.Payment, error) {
+	if errs == nil {
+		return payments, nil
+	}
+
+	log.Print(errs)
+	if s.importMode == ImportStrict {
+		return nil, errs
+	}
+	return payments, errs
+}
+
+// findShards - returns the shards of the directory written without
+// the manifest: payments.dump, payments1.dump, payments2.dump and so on.
+func findShards(entries []os.DirEntry) []historyShard {
+	numbers := map[string]int{}
+	shards := []historyShard{}
+	for _, entry := range entries {
+		name := entry.Name()
+		number := strings.TrimSuffix(strings.TrimPrefix(name, "payments"), ".dump")
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, "payments") || !strings.HasSuffix(name, ".dump") {
+			continue
+		}
+
+		if number == "" {
+			numbers[name] = 0
+		} else if n, err := strconv.Atoi(number); err == nil && n > 0 {
+			numbers[name] = n
+		} else {
+			continue
+		}
+		shards = append(shards, historyShard{name: name, records: -1})
+	}
+
+	sort.Slice(shards, func(i, j int) bool {
+		return numbers[shards[i].name] < numbers[shards[j].name]
+	})
+	return shards
+}
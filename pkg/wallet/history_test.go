@@ -0,0 +1,420 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// historyService - returns the service with 12 payments of the first account.
+func historyService(t *testing.T) (*testService, []types.Payment) {
+	s := newTestService()
+	s.SetClock(testClock(testTime))
+	Transactions(s)
+	s.Pay(1, 5, "food")
+	s.Pay(1, 5, "auto")
+	s.Pay(1, 5, "bank")
+	s.Pay(1, 5, "phone")
+
+	payments, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, payments
+}
+
+func TestService_HistoryFromFiles_success(t *testing.T) {
+	s, payments := historyService(t)
+
+	for _, records := range []int{1, 5, 12, 100} {
+		dir := t.TempDir()
+		err := s.HistoryToFiles(payments, dir, records)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		result, err := s.HistoryFromFiles(dir)
+		if err != nil {
+			t.Errorf("HistoryFromFiles(%d): error = %v", records, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(result, payments) {
+			t.Errorf("HistoryFromFiles(%d): wrong payments = %v", records, result)
+		}
+	}
+}
+
+func TestService_HistoryFromFiles_withoutManifest(t *testing.T) {
+	s, payments := historyService(t)
+
+	dir := t.TempDir()
+	err := s.HistoryToFiles(payments, dir, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = os.Remove(dir + "/" + manifestFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// payments10.dump goes after payments9.dump.
+	result, err := s.HistoryFromFiles(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(result, payments) {
+		t.Errorf("HistoryFromFiles(): wrong payments = %v", result)
+	}
+}
+
+func TestService_HistoryFromFiles_damaged(t *testing.T) {
+	s, payments := historyService(t)
+
+	dir := t.TempDir()
+	err := s.HistoryToFiles(payments, dir, 5)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the second shard is lost, the third one is changed, one more is added.
+	err = os.Remove(dir + "/payments2.dump")
+	if err == nil {
+		err = os.WriteFile(dir+"/payments3.dump", []byte("p1;1;10;auto;OK\n"), 0600)
+	}
+	if err == nil {
+		err = os.WriteFile(dir+"/payments4.dump", encodeDump(nil), 0600)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := s.HistoryFromFiles(dir)
+
+	want := []error{ErrShardUnexpected, ErrShardMissing, ErrChecksumMismatch}
+	var errs ImportErrors
+	if !errors.As(err, &errs) || len(errs) != len(want) {
+		t.Errorf("HistoryFromFiles(): wrong errors = %v", err)
+		return
+	}
+
+	for i, err := range errs {
+		if !errors.Is(err, want[i]) {
+			t.Errorf("HistoryFromFiles(): wrong error = %v, want %v", err, want[i])
+		}
+	}
+
+	if !reflect.DeepEqual(result, payments[:5]) {
+		t.Errorf("HistoryFromFiles(): wrong payments of the good shards = %v", result)
+	}
+
+	s.SetImportMode(ImportStrict)
+	result, err = s.HistoryFromFiles(dir)
+	if err == nil || result != nil {
+		t.Errorf("HistoryFromFiles(): must return only the errors in strict mode, payments = %v", result)
+	}
+}
+
+func TestService_HistoryToFiles_rewrite(t *testing.T) {
+	s, payments := historyService(t)
+	s.SetImportMode(ImportStrict)
+
+	// the directory written with the manifest and without it.
+	for _, manifest := range []bool{true, false} {
+		dir := t.TempDir()
+		err := s.HistoryToFiles(payments, dir, 3)
+		if err == nil && !manifest {
+			err = os.Remove(dir + "/" + manifestFile)
+		}
+		if err == nil {
+			err = s.HistoryToFiles(payments[:5], dir, 4)
+		}
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		result, err := s.HistoryFromFiles(dir)
+		if err != nil || !reflect.DeepEqual(result, payments[:5]) {
+			t.Errorf("HistoryFromFiles(): wrong payments = %v, error = %v", result, err)
+		}
+
+		if _, err := os.Stat(dir + "/payments3.dump"); !os.IsNotExist(err) {
+			t.Errorf("HistoryToFiles(): the old shard wasn't removed, error = %v", err)
+		}
+	}
+}
+
+func TestService_HistoryToFiles_rewriteEmpty(t *testing.T) {
+	s, payments := historyService(t)
+	s.SetImportMode(ImportStrict)
+
+	dir := t.TempDir()
+	err := s.HistoryToFiles(payments, dir, 3)
+	if err == nil {
+		err = s.HistoryToFiles([]types.Payment{}, dir, 3)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := s.HistoryFromFiles(dir)
+	if err != nil || len(result) != 0 {
+		t.Errorf("HistoryFromFiles(): the older history is read = %v, error = %v", result, err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != manifestFile {
+		t.Errorf("HistoryToFiles(): wrong files left = %v", entries)
+	}
+}
+
+func TestService_HistoryFromFiles_badShardName(t *testing.T) {
+	s, payments := historyService(t)
+
+	root := t.TempDir()
+	dir := root + "/history"
+	victim := root + "/victim.txt"
+	err := os.WriteFile(victim, []byte("data"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, name := range []string{"../victim.txt", "payments/../../victim.txt", "victim.dump", manifestFile} {
+		err = os.MkdirAll(dir, 0777)
+		if err == nil {
+			err = os.WriteFile(dir+"/"+manifestFile, encodeDump([]string{name + ";1;"}), 0666)
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, err = s.HistoryFromFiles(dir)
+		if !errors.Is(err, ErrMalformedRecord) {
+			t.Errorf("HistoryFromFiles(%q): must return ErrMalformedRecord, returned = %v", name, err)
+		}
+
+		// the shards of the manifest aren't removed by the next write.
+		err = s.HistoryToFiles(payments, dir, 5)
+		if err != nil {
+			t.Errorf("HistoryToFiles(%q): error = %v", name, err)
+		}
+		if _, err := os.Stat(victim); err != nil {
+			t.Errorf("HistoryToFiles(%q): the file outside the directory is removed, error = %v", name, err)
+		}
+	}
+}
+
+func TestService_HistoryFromFiles_notFound(t *testing.T) {
+	s := newTestService()
+	_, err := s.HistoryFromFiles(t.TempDir() + "/missing")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("HistoryFromFiles(): must return os.ErrNotExist, returned = %v", err)
+	}
+}
+
+func TestService_HistoryFromReaders_sealed(t *testing.T) {
+	s, payments := historyService(t)
+	s.SetCompression(true)
+	err := s.SetEncryptionKey(testKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	files := testFiles{}
+	err = s.HistoryToWriters(payments, 4, files.create)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	open := func(name string) (io.ReadCloser, error) {
+		buf, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+
+	result, err := s.HistoryFromReaders(open)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(result, payments) {
+		t.Errorf("HistoryFromReaders(): wrong payments = %v", result)
+	}
+
+	delete(files, manifestFile)
+	_, err = s.HistoryFromReaders(open)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("HistoryFromReaders(): must require the manifest, returned = %v", err)
+	}
+}
+
+// rotationPayments - the payments of two accounts made in two months.
+func rotationPayments() []types.Payment {
+	march := time.Date(2021, 3, 31, 23, 0, 0, 0, time.UTC)
+	april := time.Date(2021, 4, 1, 1, 0, 0, 0, time.UTC)
+	return []types.Payment{
+		{ID: "p1", AccountID: 2, Amount: 10, Category: "auto", Status: types.PaymentStatusOK, Created: april, Updated: april},
+		{ID: "p2", AccountID: 1, Amount: 20, Category: "food", Status: types.PaymentStatusOK, Created: march, Updated: march},
+		{ID: "p3", AccountID: 1, Amount: 30, Category: "bank", Status: types.PaymentStatusOK, Created: april, Updated: april},
+		{ID: "p4", AccountID: 2, Amount: 40, Category: "auto", Status: types.PaymentStatusOK, Created: march, Updated: march},
+		{ID: "p5", AccountID: 1, Amount: 50, Category: "food", Status: types.PaymentStatusOK, Created: april, Updated: april},
+	}
+}
+
+func TestService_HistoryToWritersBy(t *testing.T) {
+	payments := rotationPayments()
+	record := int64(len(formatPayment(payments[0])) + 1)
+
+	rotations := map[string]struct {
+		rotation Rotation
+		files    map[string][]string
+	}{
+		"month": {
+			Rotation{Period: RotateMonth},
+			map[string][]string{
+				"payments-2021-03.dump": {"p2", "p4"},
+				"payments-2021-04.dump": {"p1", "p3", "p5"},
+			},
+		},
+		"day and records": {
+			Rotation{Period: RotateDay, Records: 2},
+			map[string][]string{
+				"payments-2021-03-31.dump":   {"p2", "p4"},
+				"payments-2021-04-01-1.dump": {"p1", "p3"},
+				"payments-2021-04-01-2.dump": {"p5"},
+			},
+		},
+		"account and month": {
+			Rotation{Period: RotateMonth, ByAccount: true},
+			map[string][]string{
+				"payments-account1-2021-03.dump": {"p2"},
+				"payments-account1-2021-04.dump": {"p3", "p5"},
+				"payments-account2-2021-03.dump": {"p4"},
+				"payments-account2-2021-04.dump": {"p1"},
+			},
+		},
+		"size": {
+			Rotation{MaxSize: 2 * record},
+			map[string][]string{
+				"payments1.dump": {"p1", "p2"},
+				"payments2.dump": {"p3", "p4"},
+				"payments3.dump": {"p5"},
+			},
+		},
+		"tiny size": {
+			Rotation{MaxSize: 1, ByAccount: true},
+			map[string][]string{
+				"payments-account1-1.dump": {"p2"},
+				"payments-account1-2.dump": {"p3"},
+				"payments-account1-3.dump": {"p5"},
+				"payments-account2-1.dump": {"p1"},
+				"payments-account2-2.dump": {"p4"},
+			},
+		},
+	}
+
+	for name, test := range rotations {
+		s := newTestService()
+		files := testFiles{}
+		err := s.HistoryToWritersBy(payments, test.rotation, files.create)
+		if err != nil {
+			t.Errorf("HistoryToWritersBy(%s): error = %v", name, err)
+			continue
+		}
+
+		result := map[string][]string{}
+		for file, buf := range files {
+			if file == manifestFile {
+				continue
+			}
+
+			snap := newSnapshot()
+			if errs := snap.read(kindPayment, buf.Bytes(), dumpCodec{}); errs != nil {
+				t.Errorf("HistoryToWritersBy(%s): %s is broken, errors = %v", name, file, errs)
+			}
+			for _, payment := range snap.payments {
+				result[file] = append(result[file], payment.ID)
+			}
+		}
+
+		if !reflect.DeepEqual(result, test.files) {
+			t.Errorf("HistoryToWritersBy(%s): wrong files = %v, want %v", name, result, test.files)
+		}
+	}
+}
+
+func TestService_HistoryToFilesBy_roundTrip(t *testing.T) {
+	s := newTestService()
+	payments := rotationPayments()
+
+	dir := t.TempDir()
+	err := s.HistoryToFilesBy(payments, dir, Rotation{Period: RotateMonth, ByAccount: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := s.HistoryFromFiles(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ids := []string{}
+	for _, payment := range result {
+		ids = append(ids, payment.ID)
+	}
+
+	// the files go in the order of the accounts and the months.
+	if !reflect.DeepEqual(ids, []string{"p2", "p3", "p5", "p4", "p1"}) {
+		t.Errorf("HistoryFromFiles(): wrong payments = %v", ids)
+	}
+}
+
+func TestService_HistoryToFilesBy_invalid(t *testing.T) {
+	s := newTestService()
+	payments := rotationPayments()
+	dir := t.TempDir()
+
+	for _, records := range []int{0, -1} {
+		err := s.HistoryToFiles(payments, dir, records)
+		if !errors.Is(err, ErrInvalidRotation) {
+			t.Errorf("HistoryToFiles(%d): must return ErrInvalidRotation, returned = %v", records, err)
+		}
+	}
+
+	for _, rotation := range []Rotation{{Records: -1}, {MaxSize: -10}, {Period: RotationPeriod(7)}} {
+		err := s.HistoryToFilesBy(payments, dir, rotation)
+		if !errors.Is(err, ErrInvalidRotation) {
+			t.Errorf("HistoryToFilesBy(%+v): must return ErrInvalidRotation, returned = %v", rotation, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("HistoryToFilesBy(): files written with invalid rotation = %v", entries)
+	}
+}
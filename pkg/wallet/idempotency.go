@@ -0,0 +1,198 @@
+package wallet
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// DefaultIdempotencyWindow - how long the idempotency key is remembered
+// unless another window is set by SetIdempotencyWindow.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// Operations protected by idempotency keys.
+const (
+	operationPay             = "PAY"
+	operationDeposit         = "DEPOSIT"
+	operationPayFromFavorite = "PAY_FROM_FAVORITE"
+)
+
+// knownErrors - errors which are restored by their text
+// when the result of the operation is repeated.
+var knownErrors = []error{
+	ErrAmountMustBePositive,
+	ErrAccountNotFound,
+	ErrNotEnoughBalance,
+	ErrPaymentNotFound,
+	ErrFavoriteNotFound,
+}
+
+// SetIdempotencyWindow - sets how long the idempotency keys are remembered.
+func (s *Service) SetIdempotencyWindow(window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keyWindow = window
+}
+
+// idempotencyWindow - returns the window set for the service or the default one.
+func (s *Service) idempotencyWindow() time.Duration {
+	if s.keyWindow <= 0 {
+		return DefaultIdempotencyWindow
+	}
+	return s.keyWindow
+}
+
+// PayWithKey - Pay which is executed only once for the idempotency key:
+// repeated calls with the same key return the original payment(or error).
+// The empty key disables the check.
+func (s *Service) PayWithKey(key string, accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.payOnce(key, operationPay, func(tx Tx) (types.Payment, error) {
+		return s.pay(tx, accountID, amount, category)
+	})
+}
+
+// PayFromFavoriteWithKey - PayFromFavorite which is executed only once
+// for the idempotency key.
+func (s *Service) PayFromFavoriteWithKey(key string, favoriteID string) (*types.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.payOnce(key, operationPayFromFavorite, func(tx Tx) (types.Payment, error) {
+		return s.payFromFavorite(tx, favoriteID)
+	})
+}
+
+// DepositWithKey - Deposit which is executed only once for the idempotency key.
+func (s *Service) DepositWithKey(key string, accountID int64, amount types.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key == "" {
+		return s.update(func(tx Tx) error {
+			_, err := s.deposit(tx, accountID, amount)
+			return err
+		})
+	}
+
+	record, err := s.findIdempotencyKey(key, operationDeposit)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		return restoreError(record.Error)
+	}
+
+	return s.onceWithKey(key, operationDeposit, func(tx Tx) (string, error) {
+		deposit, err := s.deposit(tx, accountID, amount)
+		return deposit.ID, err
+	})
+}
+
+// payOnce - executes the payment operation unless it was already made with the key.
+func (s *Service) payOnce(key string, operation string, pay func(tx Tx) (types.Payment, error)) (*types.Payment, error) {
+	if key == "" {
+		return s.commitPayment(pay)
+	}
+
+	record, err := s.findIdempotencyKey(key, operation)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		var paymentID string
+		err = s.onceWithKey(key, operation, func(tx Tx) (string, error) {
+			payment, err := pay(tx)
+			paymentID = payment.ID
+			return payment.ID, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return paymentCopy(s.store().Payment(paymentID))
+	}
+
+	if record.Error != "" {
+		return nil, restoreError(record.Error)
+	}
+	return paymentCopy(s.store().Payment(record.Reference))
+}
+
+// onceWithKey - executes the operation and remembers its result for the key
+// in the same transaction. The failure is remembered as well, in a separate one.
+func (s *Service) onceWithKey(key string, operation string, fn func(tx Tx) (string, error)) error {
+	err := s.update(func(tx Tx) error {
+		reference, err := fn(tx)
+		if err != nil {
+			return err
+		}
+		s.rememberKey(tx, key, operation, reference, nil)
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+
+	cerr := s.update(func(tx Tx) error {
+		s.rememberKey(tx, key, operation, "", err)
+		return nil
+	})
+	if cerr != nil {
+		log.Print(cerr)
+	}
+	return err
+}
+
+// findIdempotencyKey - returns the result remembered for the key,
+// nil if the key is unknown or expired.
+func (s *Service) findIdempotencyKey(key string, operation string) (*types.IdempotencyKey, error) {
+	record, err := s.store().IdempotencyKey(key)
+	if err != nil || s.keyExpired(record) {
+		return nil, nil
+	}
+
+	if record.Operation != operation {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return record, nil
+}
+
+// keyExpired - reports whether the key is out of the idempotency window.
+func (s *Service) keyExpired(record *types.IdempotencyKey) bool {
+	return s.now().Sub(record.Created) >= s.idempotencyWindow()
+}
+
+// rememberKey - saves the result of the operation for the key,
+// the expired record of the key is replaced.
+func (s *Service) rememberKey(tx Tx, key string, operation string, reference string, err error) {
+	record := types.IdempotencyKey{
+		Key:       key,
+		Operation: operation,
+		Reference: reference,
+		Created:   s.now(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	tx.SaveIdempotencyKey(record)
+}
+
+// restoreError - returns the error with the given text,
+// the predefined errors of the package are returned as they are.
+func restoreError(text string) error {
+	if text == "" {
+		return nil
+	}
+
+	for _, err := range knownErrors {
+		if err.Error() == text {
+			return err
+		}
+	}
+	return errors.New(text)
+}
@@ -0,0 +1,198 @@
+package wallet
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_PayWithKey_repeated(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	payment, err := s.PayWithKey("key-1", 2, 50, "phone")
+	if err != nil {
+		t.Errorf("PayWithKey(): error = %v", err)
+		return
+	}
+
+	repeated, err := s.PayWithKey("key-1", 2, 50, "phone")
+	if err != nil {
+		t.Errorf("PayWithKey(): error = %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(repeated, payment) {
+		t.Errorf("PayWithKey(): new payment for the same key = %v, original = %v", repeated, payment)
+	}
+
+	account, _ := s.FindAccountByID(2)
+	if account.Balance != 110 {
+		t.Errorf("PayWithKey(): account debited twice = %v", account)
+	}
+}
+
+func TestService_PayWithKey_error(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	_, err := s.PayWithKey("key-1", 2, 500, "phone")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("PayWithKey(): must return ErrNotEnoughBalance, returned = %v", err)
+		return
+	}
+
+	err = s.Deposit(2, 1_000)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the retry returns the original result instead of paying.
+	_, err = s.PayWithKey("key-1", 2, 500, "phone")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("PayWithKey(): must return ErrNotEnoughBalance, returned = %v", err)
+	}
+
+	payment, err := s.PayWithKey("key-2", 2, 500, "phone")
+	if err != nil || payment == nil {
+		t.Errorf("PayWithKey(): error = %v", err)
+	}
+}
+
+func TestService_PayWithKey_reused(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	err := s.DepositWithKey("key-1", 2, 50)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.PayWithKey("key-1", 2, 50, "phone")
+	if err != ErrIdempotencyKeyReused {
+		t.Errorf("PayWithKey(): must return ErrIdempotencyKeyReused, returned = %v", err)
+	}
+}
+
+func TestService_PayWithKey_expired(t *testing.T) {
+	s := newTestService()
+	now := testTime
+	s.SetClock(func() time.Time { return now })
+	s.SetIdempotencyWindow(time.Hour)
+	Transactions(s)
+
+	payment, err := s.PayWithKey("key-1", 2, 50, "phone")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	now = now.Add(59 * time.Minute)
+	repeated, err := s.PayWithKey("key-1", 2, 50, "phone")
+	if err != nil || !reflect.DeepEqual(repeated, payment) {
+		t.Errorf("PayWithKey(): key expired too early, payment = %v, error = %v", repeated, err)
+		return
+	}
+
+	now = now.Add(time.Minute)
+	repeated, err = s.PayWithKey("key-1", 2, 50, "phone")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if repeated.ID == payment.ID {
+		t.Errorf("PayWithKey(): expired key returned the old payment = %v", repeated)
+	}
+}
+
+func TestService_PayFromFavoriteWithKey_repeated(t *testing.T) {
+	s := newTestService()
+	_, _, favorites, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.PayFromFavoriteWithKey("key-1", favorites[0].ID)
+	if err != nil {
+		t.Errorf("PayFromFavoriteWithKey(): error = %v", err)
+		return
+	}
+
+	repeated, err := s.PayFromFavoriteWithKey("key-1", favorites[0].ID)
+	if err != nil || !reflect.DeepEqual(repeated, payment) {
+		t.Errorf("PayFromFavoriteWithKey(): wrong repeated payment = %v, error = %v", repeated, err)
+	}
+
+	account, _ := s.FindAccountByID(1)
+	if account.Balance != 300 {
+		t.Errorf("PayFromFavoriteWithKey(): account debited twice = %v", account)
+	}
+}
+
+func TestService_DepositWithKey_repeated(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	for i := 0; i < 3; i++ {
+		err := s.DepositWithKey("key-1", 3, 100)
+		if err != nil {
+			t.Errorf("DepositWithKey(): error = %v", err)
+			return
+		}
+	}
+
+	account, _ := s.FindAccountByID(3)
+	if account.Balance != 327 {
+		t.Errorf("DepositWithKey(): account replenished more than once = %v", account)
+	}
+
+	err := s.DepositWithKey("key-2", 4, 100)
+	if err != ErrAccountNotFound {
+		t.Errorf("DepositWithKey(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
+
+func TestService_Import_idempotencyKeys(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	payment, err := s.PayWithKey("key-1", 2, 50, "phone")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.PayWithKey("key-2", 2, 5_000, "phone")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("PayWithKey(): must return ErrNotEnoughBalance, returned = %v", err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	repeated, err := imported.PayWithKey("key-1", 2, 50, "phone")
+	if err != nil || !reflect.DeepEqual(repeated, payment) {
+		t.Errorf("PayWithKey(): wrong payment after import = %v, error = %v", repeated, err)
+	}
+
+	_, err = imported.PayWithKey("key-2", 2, 5_000, "phone")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("PayWithKey(): must return ErrNotEnoughBalance after import, returned = %v", err)
+	}
+}
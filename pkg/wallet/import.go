@@ -0,0 +1,475 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// ImportMode - how Import and ImportFromFile treat the records
+// which can't be imported.
+type ImportMode int
+
+// Predefined import modes.
+const (
+	// ImportLenient - the bad records are skipped, the rest is imported
+	// and the skipped ones are returned as ImportErrors.
+	ImportLenient ImportMode = iota
+	// ImportStrict - nothing is imported if any record is bad,
+	// all of them are returned as ImportErrors.
+	ImportStrict
+)
+
+// ImportError - represents a record of the dump which can't be imported.
+type ImportError struct {
+	File   string
+	Line   int
+	Field  string
+	Reason string
+	Err    error
+}
+
+// Error - implements error interface.
+// The errors of the whole file have no line, of the whole stream - no file.
+func (e *ImportError) Error() string {
+	position := e.File
+	switch {
+	case e.Line > 0 && e.File == "":
+		position = "line " + strconv.Itoa(e.Line)
+	case e.Line > 0:
+		position += ":" + strconv.Itoa(e.Line)
+	}
+
+	reason := e.Reason
+	if e.Field != "" {
+		reason = "field " + e.Field + ": " + reason
+	}
+	if position == "" {
+		return reason
+	}
+	return position + ": " + reason
+}
+
+// Unwrap - allows errors.Is(err, ErrInvalidStatus) and the like.
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ImportErrors - represents all records rejected by the import.
+type ImportErrors []*ImportError
+
+// Error - implements error interface.
+func (e ImportErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return fmt.Sprintf("%d record(s) rejected:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// Is - reports whether any of the errors matches the target.
+func (e ImportErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetImportMode - sets how Import and ImportFromFile treat the bad records,
+// ImportLenient by default.
+func (s *Service) SetImportMode(mode ImportMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.importMode = mode
+}
+
+// MergePolicy - how the import treats the records of the file which
+// differ from the records with the same IDs already held in memory.
+type MergePolicy int
+
+// Predefined merge policies.
+const (
+	// MergeFileWins - the records of the file replace the ones in memory.
+	// The account replaced by the file with a journal takes its history
+	// too: the deposits, payments, transfers and postings of the account
+	// held in memory only are removed, unless they involve an account kept
+	// from memory. The balances are given by the journal after the merge.
+	MergeFileWins MergePolicy = iota
+	// MergeMemoryWins - the records in memory are kept, the ones of the file
+	// are skipped and only listed as conflicting by DiffImport. So are the
+	// payments, transfers, deposits and postings of the file which involve
+	// the accounts kept from memory.
+	MergeMemoryWins
+	// MergeFailOnConflict - nothing is imported if any record conflicts,
+	// the conflicts are returned as ImportErrors.
+	MergeFailOnConflict
+)
+
+// SetMergePolicy - sets how the import treats the records which differ
+// from the ones in memory, MergeFileWins by default.
+func (s *Service) SetMergePolicy(policy MergePolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mergePolicy = policy
+}
+
+// ImportDiff - what the import would do with the accounts, payments,
+// favorites, transfers, deposits and the journal of the file under the
+// merge policy.
+type ImportDiff struct {
+	// Added - the records which are not in memory yet.
+	Added []DiffEntry
+	// Changed - the records which would replace different ones in memory.
+	Changed []DiffEntry
+	// Removed - the records in memory which would be removed along with
+	// the history of the accounts replaced by the file.
+	Removed []DiffEntry
+	// Conflicting - the records which differ from the ones in memory and
+	// are kept from memory(or fail the import), as well as the accounts
+	// with the phone of another account and the records which involve
+	// the accounts kept from memory.
+	Conflicting []DiffEntry
+	// Errors - the errors the import would return.
+	Errors ImportErrors
+}
+
+// DiffEntry - the record of ImportDiff.
+type DiffEntry struct {
+	Kind string
+	ID   string
+}
+
+// DiffImport - returns what Import of the directory would add, change,
+// remove or find conflicting, without changing anything.
+func (s *Service) DiffImport(dir string) (*ImportDiff, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap, errs, err := readDump(dir, s.codec)
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+
+	plan := s.planImport(snap, errs)
+	plan.diff.Errors = plan.errs
+	return &plan.diff, nil
+}
+
+// importPlan - the records of the snapshot to save into the storage,
+// as decided by the merge policy, and what is done with the others.
+// kept - the accounts of the file kept from memory(or rejected), remove -
+// the IDs of the records to remove from the storage by the kinds.
+type importPlan struct {
+	source *snapshot
+	policy MergePolicy
+	save   *snapshot
+	kept   map[int64]bool
+	remove map[recordKind][]string
+	diff   ImportDiff
+	errs   ImportErrors
+}
+
+// planImport - decides which records of the snapshot are saved into the
+// storage. The records equal to the ones in memory are not saved again,
+// the rejected ones are added to the errors of reading.
+//
+// The history of every account follows the account: the records and
+// postings of the file which involve an account kept from memory are
+// skipped, and the account replaced by the file with a journal takes
+// the history of the file, see MergeFileWins.
+func (s *Service) planImport(snap *snapshot, errs ImportErrors) *importPlan {
+	store := s.store()
+	plan := &importPlan{
+		source: snap,
+		policy: s.mergePolicy,
+		save:   &snapshot{nextAccountID: snap.nextAccountID, increment: snap.increment},
+		kept:   make(map[int64]bool),
+		remove: make(map[recordKind][]string),
+		errs:   errs,
+	}
+
+	// the journal of the whole dump by the accounts: the account whose
+	// postings differ from the ones in memory differs too. The increment
+	// has the postings made since the checkpoint only.
+	var journal map[int64][]string
+	if snap.found[kindPosting] && snap.increment == nil {
+		journal = make(map[int64][]string)
+		for _, posting := range snap.postings {
+			for _, id := range postingAccounts(posting) {
+				journal[id] = append(journal[id], posting.ID)
+			}
+		}
+	}
+	replaced := make(map[int64]bool)
+
+	for i, account := range snap.accounts {
+		id := strconv.FormatInt(account.ID, 10)
+		other, _ := store.AccountByPhone(account.Phone)
+		if other != nil && other.ID != account.ID {
+			err := fmt.Errorf("%w: %s belongs to account %d", ErrPhoneRegistered, account.Phone, other.ID)
+			plan.conflict(kindAccount, i, id, "phone", err)
+			if plan.policy == MergeFileWins {
+				// the file can't win, the phone would belong to two accounts.
+				plan.reject(kindAccount, i, "phone", err)
+			}
+			plan.kept[account.ID] = true
+			continue
+		}
+
+		existing, _ := store.Account(account.ID)
+		same := existing != nil && formatAccount(*existing) == formatAccount(account)
+		if same && journal != nil {
+			same = sameJournal(store.PostingsByLedger(types.CustomerLedger(account.ID)), journal[account.ID])
+		}
+		switch {
+		case plan.merge(kindAccount, i, id, existing != nil, same, nil):
+			plan.save.accounts = append(plan.save.accounts, account)
+			replaced[account.ID] = existing != nil && journal != nil
+		case !same:
+			plan.kept[account.ID] = true
+		}
+	}
+
+	for i, payment := range snap.payments {
+		existing, _ := store.Payment(payment.ID)
+		var current *types.PaymentStatus
+		if existing != nil {
+			current = &existing.Status
+			// dumps written before timestamps were added have no such fields.
+			if payment.Created.IsZero() && payment.Updated.IsZero() {
+				payment.Created = existing.Created
+				payment.Updated = existing.Updated
+			}
+		}
+
+		same := existing != nil && formatPayment(*existing) == formatPayment(payment)
+		if plan.kept[payment.AccountID] {
+			if !same {
+				plan.skip(kindPayment, i, payment.ID, payment.AccountID)
+			}
+			continue
+		}
+		check := func() error {
+			return checkImportedTransition(payment.ID, current, payment.Status)
+		}
+		if plan.merge(kindPayment, i, payment.ID, existing != nil, same, check) {
+			plan.save.payments = append(plan.save.payments, payment)
+		}
+	}
+
+	for i, favorite := range snap.favorites {
+		existing, _ := store.Favorite(favorite.ID)
+		if existing != nil && favorite.Created.IsZero() {
+			favorite.Created = existing.Created
+		}
+
+		same := existing != nil && formatFavorite(*existing) == formatFavorite(favorite)
+		if plan.merge(kindFavorite, i, favorite.ID, existing != nil, same, nil) {
+			plan.save.favorites = append(plan.save.favorites, favorite)
+		}
+	}
+
+	for i, transfer := range snap.transfers {
+		existing, _ := store.Transfer(transfer.ID)
+		var current *types.PaymentStatus
+		if existing != nil {
+			current = &existing.Status
+			if transfer.Created.IsZero() && transfer.Updated.IsZero() {
+				transfer.Created = existing.Created
+				transfer.Updated = existing.Updated
+			}
+		}
+
+		same := existing != nil && formatTransfer(*existing) == formatTransfer(transfer)
+		if plan.kept[transfer.FromAccountID] || plan.kept[transfer.ToAccountID] {
+			if !same {
+				plan.skip(kindTransfer, i, transfer.ID, transfer.FromAccountID, transfer.ToAccountID)
+			}
+			continue
+		}
+		check := func() error {
+			return checkImportedTransition(transfer.ID, current, transfer.Status)
+		}
+		if plan.merge(kindTransfer, i, transfer.ID, existing != nil, same, check) {
+			plan.save.transfers = append(plan.save.transfers, transfer)
+		}
+	}
+
+	// deposits and postings never change, the known ones are in memory.
+	known := make(map[string]bool)
+	for _, deposit := range store.Deposits() {
+		known[deposit.ID] = true
+	}
+	for i, deposit := range snap.deposits {
+		switch {
+		case known[deposit.ID]:
+		case plan.kept[deposit.AccountID]:
+			plan.skip(kindDeposit, i, deposit.ID, deposit.AccountID)
+		default:
+			plan.diff.Added = append(plan.diff.Added, DiffEntry{Kind: string(kindDeposit), ID: deposit.ID})
+			plan.save.deposits = append(plan.save.deposits, deposit)
+		}
+	}
+
+	known = make(map[string]bool)
+	for _, posting := range store.Postings() {
+		known[posting.ID] = true
+	}
+	for i, posting := range snap.postings {
+		accounts := postingAccounts(posting)
+		switch {
+		case known[posting.ID]:
+		case plan.keeps(accounts):
+			plan.skip(kindPosting, i, posting.ID, accounts...)
+		default:
+			plan.diff.Added = append(plan.diff.Added, DiffEntry{Kind: string(kindPosting), ID: posting.ID})
+			plan.save.postings = append(plan.save.postings, posting)
+		}
+	}
+
+	plan.replaceHistory(store, replaced)
+	plan.save.keys = s.liveKeys(snap.keys)
+	return plan
+}
+
+// sameJournal - reports whether the postings are the ones with the IDs.
+func sameJournal(postings []*types.Posting, ids []string) bool {
+	if len(postings) != len(ids) {
+		return false
+	}
+
+	known := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		known[id] = true
+	}
+	for _, posting := range postings {
+		if !known[posting.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+// keeps - reports whether any of the accounts is kept from memory.
+func (p *importPlan) keeps(accountIDs []int64) bool {
+	for _, id := range accountIDs {
+		if p.kept[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceHistory - removes the deposits, payments, transfers and postings
+// held in memory only of the accounts replaced by the file. The ones which
+// involve an account not replaced stay, the journal gives the balances.
+func (p *importPlan) replaceHistory(store Storage, replaced map[int64]bool) {
+	inFile := make(map[recordKind]map[string]bool)
+	for _, kind := range []recordKind{kindPayment, kindTransfer, kindDeposit, kindPosting} {
+		inFile[kind] = make(map[string]bool)
+	}
+	for _, payment := range p.source.payments {
+		inFile[kindPayment][payment.ID] = true
+	}
+	for _, transfer := range p.source.transfers {
+		inFile[kindTransfer][transfer.ID] = true
+	}
+	for _, deposit := range p.source.deposits {
+		inFile[kindDeposit][deposit.ID] = true
+	}
+	for _, posting := range p.source.postings {
+		inFile[kindPosting][posting.ID] = true
+	}
+
+	remove := func(kind recordKind, id string, accountIDs ...int64) {
+		if inFile[kind][id] || len(accountIDs) == 0 {
+			return
+		}
+		for _, accountID := range accountIDs {
+			if !replaced[accountID] {
+				return
+			}
+		}
+		p.remove[kind] = append(p.remove[kind], id)
+		p.diff.Removed = append(p.diff.Removed, DiffEntry{Kind: string(kind), ID: id})
+	}
+
+	for _, payment := range store.Payments() {
+		remove(kindPayment, payment.ID, payment.AccountID)
+	}
+	for _, transfer := range store.Transfers() {
+		remove(kindTransfer, transfer.ID, transfer.FromAccountID, transfer.ToAccountID)
+	}
+	for _, deposit := range store.Deposits() {
+		remove(kindDeposit, deposit.ID, deposit.AccountID)
+	}
+	for _, posting := range store.Postings() {
+		remove(kindPosting, posting.ID, postingAccounts(*posting)...)
+	}
+}
+
+// merge - decides whether the record of the file is saved and puts it
+// to the diff. exists - the record with the ID is in memory, same - it is
+// equal to the one of the file, check - validates the record which is
+// about to replace the one in memory(or be added).
+func (p *importPlan) merge(kind recordKind, i int, id string, exists, same bool, check func() error) bool {
+	if same {
+		return false
+	}
+
+	if exists && p.policy != MergeFileWins {
+		p.conflict(kind, i, id, "", fmt.Errorf("%w: differs from the record in memory (id %s)", ErrImportConflict, id))
+		return false
+	}
+
+	if check != nil {
+		if err := check(); err != nil {
+			p.reject(kind, i, "status", err)
+			return false
+		}
+	}
+
+	if exists {
+		p.diff.Changed = append(p.diff.Changed, DiffEntry{Kind: string(kind), ID: id})
+	} else {
+		p.diff.Added = append(p.diff.Added, DiffEntry{Kind: string(kind), ID: id})
+	}
+	return true
+}
+
+// skip - puts the record of the file which involves the accounts kept
+// from memory to the diff, it is skipped with them.
+func (p *importPlan) skip(kind recordKind, i int, id string, accountIDs ...int64) {
+	err := fmt.Errorf("%w: account(s) %v kept from memory (id %s)", ErrImportConflict, accountIDs, id)
+	p.conflict(kind, i, id, "", err)
+}
+
+// conflict - puts the record which conflicts with memory to the diff,
+// it is rejected only under MergeFailOnConflict.
+func (p *importPlan) conflict(kind recordKind, i int, id string, field string, err error) {
+	p.diff.Conflicting = append(p.diff.Conflicting, DiffEntry{Kind: string(kind), ID: id})
+	if p.policy == MergeFailOnConflict {
+		p.reject(kind, i, field, err)
+	}
+}
+
+// reject - adds the error of the i-th record of the kind.
+func (p *importPlan) reject(kind recordKind, i int, field string, err error) {
+	log.Print(err)
+	p.errs = append(p.errs, &ImportError{
+		File:   p.source.file(kind),
+		Line:   p.source.lines[kind][i],
+		Field:  field,
+		Reason: err.Error(),
+		Err:    err,
+	})
+}
@@ -0,0 +1,506 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// writeBadDump - writes the dump files with some bad records
+// and returns the expected errors.
+func writeBadDump(t *testing.T, dir string) []ImportError {
+	files := map[string]string{
+		"accounts.dump": "1;+1111;400\n2;+2222;abc\n\n3;+3333;100\n",
+		"payments.dump": "p1;1;100;auto;INPROGRESS\np2;1\np3;1;10;auto;DONE\np4;x;10;auto;OK\n",
+	}
+	for name, data := range files {
+		err := os.WriteFile(dir+"/"+name, []byte(data), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return []ImportError{
+		{File: "accounts.dump", Line: 2, Field: "balance"},
+		{File: "payments.dump", Line: 2, Field: ""},
+		{File: "payments.dump", Line: 4, Field: "account_id"},
+		{File: "payments.dump", Line: 3, Field: "status"},
+	}
+}
+
+// checkImportErrors - compares the positions of the errors with the expected ones.
+func checkImportErrors(t *testing.T, err error, want []ImportError) {
+	var errs ImportErrors
+	if !errors.As(err, &errs) {
+		t.Errorf("Import(): must return ImportErrors, returned = %v", err)
+		return
+	}
+
+	got := []ImportError{}
+	for _, e := range errs {
+		got = append(got, ImportError{File: e.File, Line: e.Line, Field: e.Field})
+		if e.Reason == "" || e.Err == nil {
+			t.Errorf("Import(): error without the reason = %#v", e)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Import(): wrong errors = %v, want = %v", got, want)
+	}
+}
+
+func TestService_Import_strict(t *testing.T) {
+	dir := t.TempDir()
+	want := writeBadDump(t, dir)
+
+	s := newTestService()
+	s.SetImportMode(ImportStrict)
+
+	err := s.Import(dir)
+	checkImportErrors(t, err, want)
+
+	if !errors.Is(err, ErrInvalidStatus) || !errors.Is(err, ErrMalformedRecord) {
+		t.Errorf("Import(): errors must wrap the causes = %v", err)
+	}
+
+	if accounts := s.store().Accounts(); len(accounts) != 0 {
+		t.Errorf("Import(): service changed in strict mode, accounts = %v", accounts)
+	}
+	if payments := s.store().Payments(); len(payments) != 0 {
+		t.Errorf("Import(): service changed in strict mode, payments = %v", payments)
+	}
+}
+
+func TestService_Import_lenient(t *testing.T) {
+	dir := t.TempDir()
+	want := writeBadDump(t, dir)
+
+	s := newTestService()
+	err := s.Import(dir)
+	checkImportErrors(t, err, want)
+
+	// the record after the empty line is imported too.
+	for _, id := range []int64{1, 3} {
+		if _, err := s.FindAccountByID(id); err != nil {
+			t.Errorf("Import(): account %d wasn't imported, error = %v", id, err)
+		}
+	}
+	if _, err := s.FindAccountByID(2); err != ErrAccountNotFound {
+		t.Errorf("Import(): bad account imported, error = %v", err)
+	}
+
+	if payments := s.store().Payments(); len(payments) != 1 || payments[0].ID != "p1" {
+		t.Errorf("Import(): wrong payments = %v", payments)
+	}
+}
+
+func TestService_Import_strictSuccess(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	imported.SetImportMode(ImportStrict)
+	err = imported.Import(dir)
+	if err != nil {
+		t.Errorf("Import(): error = %v", err)
+	}
+
+	if report := imported.Verify(); !report.OK() {
+		t.Errorf("Import(): issues = %v", report.Issues)
+	}
+}
+
+func TestService_ImportFromFile_strict(t *testing.T) {
+	path := t.TempDir() + "/accounts.txt"
+	err := os.WriteFile(path, []byte("1;+1111;400|2;+2222|3;+3333;x"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	s.SetImportMode(ImportStrict)
+	err = s.ImportFromFile(path)
+	checkImportErrors(t, err, []ImportError{
+		{File: "accounts.txt", Line: 2},
+		{File: "accounts.txt", Line: 3, Field: "balance"},
+	})
+
+	if accounts := s.store().Accounts(); len(accounts) != 0 {
+		t.Errorf("ImportFromFile(): service changed in strict mode, accounts = %v", accounts)
+	}
+
+	s.SetImportMode(ImportLenient)
+	err = s.ImportFromFile(path)
+	checkImportErrors(t, err, []ImportError{
+		{File: "accounts.txt", Line: 2},
+		{File: "accounts.txt", Line: 3, Field: "balance"},
+	})
+
+	if accounts := s.store().Accounts(); len(accounts) != 1 || accounts[0].Balance != 400 {
+		t.Errorf("ImportFromFile(): wrong accounts = %v", accounts)
+	}
+}
+
+func TestService_Import_garbage(t *testing.T) {
+	inputs := []string{"", ";", ";;;;;;;;", "\n\n\n", "1", "a;b;c", "1;2;3;4;5;6;7;8;9;10", "\x00\xff;\r\n"}
+	for _, input := range inputs {
+		dir := t.TempDir()
+		for _, kind := range recordKinds {
+			err := os.WriteFile(dumpPath(dir, kind), []byte(input), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s := newTestService()
+		s.Import(dir)
+
+		err := os.WriteFile(dir+"/file", []byte(input), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ImportFromFile(dir + "/file")
+	}
+}
+
+func TestImportError_Error(t *testing.T) {
+	err := &ImportError{File: "payments.dump", Line: 3, Field: "amount", Reason: `"x" is not a number`}
+	if got := err.Error(); got != `payments.dump:3: field amount: "x" is not a number` {
+		t.Errorf("Error(): wrong text = %q", got)
+	}
+
+	errs := ImportErrors{err, {File: "accounts.dump", Line: 1, Reason: "expected at least 3 fields, got 1"}}
+	want := "2 record(s) rejected:\n" +
+		`payments.dump:3: field amount: "x" is not a number` + "\n" +
+		"accounts.dump:1: expected at least 3 fields, got 1"
+	if got := errs.Error(); got != want {
+		t.Errorf("Error(): wrong text = %q", got)
+	}
+
+	// the errors of the whole file or the whole stream.
+	err = &ImportError{File: "payments1.dump", Reason: "listed in the manifest, but missing"}
+	if got := err.Error(); got != "payments1.dump: listed in the manifest, but missing" {
+		t.Errorf("Error(): wrong text = %q", got)
+	}
+
+	err = &ImportError{Field: "version", Reason: "version 2, supported up to 1"}
+	if got := err.Error(); got != "field version: version 2, supported up to 1" {
+		t.Errorf("Error(): wrong text = %q", got)
+	}
+}
+
+// mergeServices - returns the dump of the service with a new account and
+// the function making the service which has imported the older dump
+// and changed the balance of the first account since.
+func mergeServices(t *testing.T) (string, func() *testService) {
+	source := newTestService()
+	Transactions(source)
+
+	base := t.TempDir()
+	err := source.Export(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = source.RegisterAccount("5555")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	err = source.Export(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := func() *testService {
+		s := newTestService()
+		err := s.Import(base)
+		if err == nil {
+			err = s.Deposit(1, 100)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	return dir, target
+}
+
+func TestService_DiffImport_policies(t *testing.T) {
+	dir, target := mergeServices(t)
+
+	added := []DiffEntry{{Kind: "accounts", ID: "4"}}
+	account := []DiffEntry{{Kind: "accounts", ID: "1"}}
+	policies := map[MergePolicy]struct {
+		changed     []DiffEntry
+		removed     []string
+		conflicting []DiffEntry
+	}{
+		// the deposit made in memory goes with the account replaced.
+		MergeFileWins:       {changed: account, removed: []string{"deposits", "journal"}},
+		MergeMemoryWins:     {conflicting: account},
+		MergeFailOnConflict: {conflicting: account},
+	}
+
+	for policy, want := range policies {
+		s := target()
+		s.SetMergePolicy(policy)
+		before := takeSnapshot(s.store())
+
+		diff, err := s.DiffImport(dir)
+		if err != nil {
+			t.Errorf("DiffImport(%v): error = %v", policy, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(diff.Added, added) || !reflect.DeepEqual(diff.Changed, want.changed) || !reflect.DeepEqual(diff.Conflicting, want.conflicting) {
+			t.Errorf("DiffImport(%v): wrong diff = %+v", policy, diff)
+		}
+		if !reflect.DeepEqual(diffKinds(diff.Removed), want.removed) {
+			t.Errorf("DiffImport(%v): wrong removed = %+v", policy, diff.Removed)
+		}
+
+		if (policy == MergeFailOnConflict) != errors.Is(diff.Errors, ErrImportConflict) {
+			t.Errorf("DiffImport(%v): wrong errors = %v", policy, diff.Errors)
+		}
+
+		if !reflect.DeepEqual(takeSnapshot(s.store()), before) {
+			t.Errorf("DiffImport(%v): service changed", policy)
+		}
+	}
+}
+
+func TestService_Import_policies(t *testing.T) {
+	dir, target := mergeServices(t)
+
+	policies := map[MergePolicy]struct {
+		balance  types.Money
+		accounts int
+		err      error
+	}{
+		// the deposit made in memory goes with the account replaced.
+		MergeFileWins:       {balance: 500 - 250, accounts: 4},
+		MergeMemoryWins:     {balance: 500 - 250 + 100, accounts: 4},
+		MergeFailOnConflict: {balance: 500 - 250 + 100, accounts: 3, err: ErrImportConflict},
+	}
+
+	for policy, want := range policies {
+		s := target()
+		s.SetMergePolicy(policy)
+
+		err := s.Import(dir)
+		if !errors.Is(err, want.err) || (want.err == nil && err != nil) {
+			t.Errorf("Import(%v): wrong error = %v", policy, err)
+		}
+
+		account, err := s.FindAccountByID(1)
+		if err != nil || account.Balance != want.balance {
+			t.Errorf("Import(%v): wrong account = %v, error = %v", policy, account, err)
+		}
+
+		if len(s.store().Accounts()) != want.accounts {
+			t.Errorf("Import(%v): wrong accounts = %v", policy, len(s.store().Accounts()))
+		}
+
+		if err := s.VerifyJournal(); err != nil {
+			t.Errorf("Import(%v): journal doesn't match the balances, error = %v", policy, err)
+		}
+		if report := s.Verify(); !report.OK() {
+			t.Errorf("Import(%v): wrong issues = %v", policy, report.Issues)
+		}
+	}
+}
+
+// diffKinds - returns the kinds of the entries of the diff.
+func diffKinds(entries []DiffEntry) []string {
+	var kinds []string
+	for _, entry := range entries {
+		kinds = append(kinds, entry.Kind)
+	}
+	return kinds
+}
+
+func TestService_Import_divergedHistory(t *testing.T) {
+	source := newTestService()
+	account, err := source.RegisterAccount("1111")
+	if err == nil {
+		err = source.Deposit(account.ID, 100)
+	}
+	if err == nil {
+		err = source.Deposit(account.ID, 50)
+	}
+	dir := t.TempDir()
+	if err == nil {
+		err = source.Export(dir)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policies := map[MergePolicy]struct {
+		balance     types.Money
+		added       []string
+		removed     []string
+		conflicting []string
+		err         error
+	}{
+		MergeFileWins: {
+			balance: 150,
+			added:   []string{"deposits", "deposits", "journal", "journal"},
+			removed: []string{"deposits", "journal"},
+		},
+		MergeMemoryWins: {
+			balance:     100,
+			conflicting: []string{"accounts", "deposits", "deposits", "journal", "journal"},
+		},
+		MergeFailOnConflict: {
+			balance:     100,
+			conflicting: []string{"accounts", "deposits", "deposits", "journal", "journal"},
+			err:         ErrImportConflict,
+		},
+	}
+
+	for policy, want := range policies {
+		s := newTestService()
+		account, err := s.RegisterAccount("1111")
+		if err == nil {
+			err = s.Deposit(account.ID, 100)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetMergePolicy(policy)
+
+		diff, err := s.DiffImport(dir)
+		if err != nil {
+			t.Errorf("DiffImport(%v): error = %v", policy, err)
+			continue
+		}
+		if !reflect.DeepEqual(diffKinds(diff.Added), want.added) || !reflect.DeepEqual(diffKinds(diff.Removed), want.removed) ||
+			!reflect.DeepEqual(diffKinds(diff.Conflicting), want.conflicting) {
+			t.Errorf("DiffImport(%v): wrong diff = %+v", policy, diff)
+		}
+
+		err = s.Import(dir)
+		if !errors.Is(err, want.err) || (want.err == nil && err != nil) {
+			t.Errorf("Import(%v): wrong error = %v", policy, err)
+		}
+
+		account, err = s.FindAccountByID(account.ID)
+		if err != nil || account.Balance != want.balance {
+			t.Errorf("Import(%v): wrong account = %v, error = %v", policy, account, err)
+		}
+
+		if err := s.VerifyJournal(); err != nil {
+			t.Errorf("Import(%v): journal doesn't match the balances, error = %v", policy, err)
+		}
+		if report := s.Verify(); !report.OK() {
+			t.Errorf("Import(%v): wrong issues = %v", policy, report.Issues)
+		}
+	}
+}
+
+func TestService_Import_olderDump(t *testing.T) {
+	s := newTestService()
+	account, err := s.RegisterAccount("1111")
+	if err == nil {
+		err = s.Deposit(account.ID, 100)
+	}
+	dir := t.TempDir()
+	if err == nil {
+		err = s.Export(dir)
+	}
+	if err == nil {
+		_, err = s.Pay(account.ID, 10, "food")
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the account of the dump replaces the one in memory along with its
+	// history, the payment made since is removed.
+	err = s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err = s.FindAccountByID(account.ID)
+	if err != nil || account.Balance != 100 {
+		t.Errorf("Import(): wrong account = %v, error = %v", account, err)
+	}
+	if len(s.store().Payments()) != 0 {
+		t.Errorf("Import(): wrong payments = %v", s.store().Payments())
+	}
+
+	if err := s.VerifyJournal(); err != nil {
+		t.Errorf("Import(): journal doesn't match the balances, error = %v", err)
+	}
+	if report := s.Verify(); !report.OK() {
+		t.Errorf("Import(): wrong issues = %v", report.Issues)
+	}
+}
+
+func TestService_Import_phoneConflict(t *testing.T) {
+	s := newTestService()
+	_, err := s.RegisterAccount("1111")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.ImportFromReader(strings.NewReader("7;1111;100|8;8888;50"))
+	var errs ImportErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || !errors.Is(errs[0], ErrPhoneRegistered) || errs[0].Line != 1 {
+		t.Errorf("ImportFromReader(): wrong errors = %v", err)
+	}
+
+	account, err := s.store().AccountByPhone("1111")
+	if err != nil || account.ID != 1 {
+		t.Errorf("ImportFromReader(): phone taken by the imported account = %v", account)
+	}
+
+	if _, err := s.FindAccountByID(7); err == nil {
+		t.Errorf("ImportFromReader(): account with the phone of another one imported")
+	}
+}
+
+func TestService_Import_nextAccountID(t *testing.T) {
+	s := newTestService()
+	s.RegisterAccount("1111")
+
+	err := s.ImportFromReader(strings.NewReader("10;1010;100|3;3333;50"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the second import changes nothing.
+	err = s.ImportFromReader(strings.NewReader("10;1010;100|3;3333;50"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := s.RegisterAccount("2222")
+	if err != nil || account.ID != 11 {
+		t.Errorf("RegisterAccount(): wrong account after the import = %v, error = %v", account, err)
+	}
+
+	if len(s.store().Accounts()) != 4 {
+		t.Errorf("RegisterAccount(): imported account replaced = %v", s.store().Accounts())
+	}
+}
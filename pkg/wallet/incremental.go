@@ -0,0 +1,512 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// incrementFile - the entry of the increment archive with its checkpoints
+// and the IDs of the records deleted since the older one.
+//
+// The lines of the entry look like:
+//
+//	checkpoint;<since>;<new checkpoint>;<ID of the last registered account>
+//	deleted;<kind>;<ID>
+const incrementFile = "increment.dump"
+
+// incremental - the storage which remembers the commit that changed every
+// record last, so only the records changed since a checkpoint can be
+// exported. MemoryStorage and FileStorage are such storages.
+type incremental interface {
+	checkpoint() string
+	changesSince(checkpoint string) (*snapshot, error)
+	compact(checkpoint string) error
+	lastImported() string
+}
+
+// importedCheckpoint - the checkpoint of the last increment imported,
+// saved by the transaction of the import.
+type importedCheckpoint string
+
+// checkpointTx - the transaction of the incremental storage, which saves
+// the checkpoint of the increment together with its records.
+type checkpointTx interface {
+	saveCheckpoint(checkpoint string)
+}
+
+// recordChange - the commit which changed(or deleted) the record last.
+type recordChange struct {
+	seq     uint64
+	deleted bool
+}
+
+// increment - the checkpoint the increment is written since(empty for
+// the base one), the checkpoint it brings the wallet to and the IDs
+// of the records deleted in between.
+type increment struct {
+	from    string
+	to      string
+	deleted map[recordKind][]string
+}
+
+// ExportIncrement - writes the records created, changed or deleted since
+// the checkpoint as the tar archive of ExportDump with the increment
+// entry, and returns the checkpoint to pass to the next call. The empty
+// checkpoint exports all records: that is the base of the chain.
+//
+// The checkpoints are known to the storage until they are compacted by
+// CompactIncrements, and until MemoryStorage is gone; FileStorage keeps
+// them when it is reopened. The chain of the unknown checkpoint starts
+// again with a new base.
+func (s *Service) ExportIncrement(w io.Writer, checkpoint string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	store, ok := s.store().(incremental)
+	if !ok {
+		return "", ErrIncrementalUnsupported
+	}
+
+	snap, err := store.changesSince(checkpoint)
+	if err != nil {
+		log.Print(err)
+		return "", err
+	}
+	snap.keys = s.liveKeys(snap.keys)
+	snap.nextAccountID = s.nextAccountID
+
+	err = writeArchive(w, snap, s.codec)
+	if err != nil {
+		log.Print(err)
+		return "", err
+	}
+	return snap.increment.to, nil
+}
+
+// ExportIncrementToFile - writes the increment of ExportIncrement to the file.
+func (s *Service) ExportIncrementToFile(path string, checkpoint string) (string, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, filePerm)
+	if err != nil {
+		log.Print(err)
+		return "", err
+	}
+
+	next, err := s.ExportIncrement(file, checkpoint)
+	if cerr := file.Close(); err == nil && cerr != nil {
+		log.Print(cerr)
+		return "", cerr
+	}
+	return next, err
+}
+
+// ImportIncrement - import(reads) the increment written by ExportIncrement.
+// The base increment may be imported at any time, the others only in the
+// order they were written, each one right after the increment it was
+// written since. The deleted records are removed.
+//
+// The checkpoint of the last increment imported is kept by the storage
+// together with the records: FileStorage keeps it(and the checkpoints
+// it gives to ExportIncrement) when it is reopened. Export and the other
+// dumps don't write it, the service restored from a dump starts with
+// the base again.
+func (s *Service) ImportIncrement(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, errs, err := readArchive(r, s.codec)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+
+	if snap.increment == nil {
+		return &ImportError{File: incrementFile, Reason: "the archive is not an increment", Err: ErrMalformedRecord}
+	}
+
+	last := s.lastIncrement
+	if store, ok := s.store().(incremental); ok {
+		last = store.lastImported()
+	}
+	if snap.increment.from != "" && snap.increment.from != last {
+		return fmt.Errorf("%w: written since %q, the last one imported is %q", ErrIncrementOutOfOrder, snap.increment.from, last)
+	}
+
+	err = s.importSnapshot(snap, errs)
+	var rejected ImportErrors
+	if err == nil || (s.importMode == ImportLenient && errors.As(err, &rejected)) {
+		s.lastIncrement = snap.increment.to
+	}
+	return err
+}
+
+// CompactIncrements - forgets the changes made up to the checkpoint, which
+// is the oldest one still in use by the chains of the increments. The storage
+// remembers the commit of every record changed since and the IDs of the
+// records deleted since only, so the increments can't be exported since
+// the older checkpoints any more: ErrUnknownCheckpoint is returned for them.
+func (s *Service) CompactIncrements(checkpoint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	store, ok := s.store().(incremental)
+	if !ok {
+		return ErrIncrementalUnsupported
+	}
+
+	err := store.compact(checkpoint)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	return nil
+}
+
+// ImportIncrements - imports the increment files in the given order, the
+// first one is usually the base. The chain stops at the first increment
+// which can't be imported; the records skipped in the lenient mode don't
+// stop it and are returned together, named by the file and the entry.
+func (s *Service) ImportIncrements(paths ...string) error {
+	var errs ImportErrors
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Print(err)
+			return err
+		}
+
+		err = s.ImportIncrement(file)
+		if cerr := file.Close(); cerr != nil {
+			log.Print(cerr)
+		}
+
+		var rejected ImportErrors
+		if err != nil && !errors.As(err, &rejected) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, ferr := range rejected {
+			ferr.File = filepath.Join(filepath.Base(path), ferr.File)
+		}
+		errs = append(errs, rejected...)
+
+		if err != nil && s.importMode == ImportStrict {
+			return errs
+		}
+	}
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// checkpoint - returns the checkpoint of the last commit.
+func (m *MemoryStorage) checkpoint() string {
+	return m.epoch + ":" + strconv.FormatUint(m.seq, 10)
+}
+
+// track - remembers the last commit which changed the record.
+func (m *MemoryStorage) track(c change) {
+	if m.changed == nil {
+		m.changed = make(map[recordKind]map[string]recordChange)
+	}
+	if m.changed[c.kind] == nil {
+		m.changed[c.kind] = make(map[string]recordChange)
+	}
+	m.changed[c.kind][changeID(c)] = recordChange{seq: m.seq, deleted: c.delete}
+}
+
+// lastImported - returns the checkpoint of the last increment imported.
+func (m *MemoryStorage) lastImported() string {
+	return m.lastIncrement
+}
+
+// changeID - returns the ID of the record saved or deleted by the change.
+func changeID(c change) string {
+	switch record := c.record.(type) {
+	case int64:
+		return strconv.FormatInt(record, 10)
+	case string:
+		return record
+	case types.Account:
+		return strconv.FormatInt(record.ID, 10)
+	case types.Payment:
+		return record.ID
+	case types.Favorite:
+		return record.ID
+	case types.Transfer:
+		return record.ID
+	case types.Deposit:
+		return record.ID
+	case types.Posting:
+		return record.ID
+	case types.IdempotencyKey:
+		return record.Key
+	}
+	return ""
+}
+
+// since - returns the number of the commit of the checkpoint,
+// 0 for the empty one.
+func (m *MemoryStorage) since(checkpoint string) (uint64, error) {
+	if checkpoint == "" {
+		return 0, nil
+	}
+
+	i := strings.LastIndexByte(checkpoint, ':')
+	if i < 0 || checkpoint[:i] != m.epoch {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCheckpoint, checkpoint)
+	}
+
+	seq, err := strconv.ParseUint(checkpoint[i+1:], 10, 64)
+	if err != nil || seq > m.seq || seq < m.compacted {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCheckpoint, checkpoint)
+	}
+	return seq, nil
+}
+
+// changesSince - copies the records changed after the checkpoint,
+// the increment of the snapshot has the IDs of the deleted ones.
+func (m *MemoryStorage) changesSince(checkpoint string) (*snapshot, error) {
+	seq, err := m.since(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// the base has all records, the compacted ones have no commit.
+	changed := func(kind recordKind, id string) bool {
+		return seq == 0 || m.changed[kind][id].seq > seq
+	}
+
+	snap := &snapshot{increment: &increment{
+		from:    checkpoint,
+		to:      m.checkpoint(),
+		deleted: make(map[recordKind][]string),
+	}}
+	for _, account := range m.accounts {
+		if changed(kindAccount, strconv.FormatInt(account.ID, 10)) {
+			snap.accounts = append(snap.accounts, *account)
+		}
+	}
+	for _, payment := range m.payments {
+		if changed(kindPayment, payment.ID) {
+			snap.payments = append(snap.payments, *payment)
+		}
+	}
+	for _, favorite := range m.favorites {
+		if changed(kindFavorite, favorite.ID) {
+			snap.favorites = append(snap.favorites, *favorite)
+		}
+	}
+	for _, transfer := range m.transfers {
+		if changed(kindTransfer, transfer.ID) {
+			snap.transfers = append(snap.transfers, *transfer)
+		}
+	}
+	for _, deposit := range m.deposits {
+		if changed(kindDeposit, deposit.ID) {
+			snap.deposits = append(snap.deposits, *deposit)
+		}
+	}
+	for _, posting := range m.postings {
+		if changed(kindPosting, posting.ID) {
+			snap.postings = append(snap.postings, *posting)
+		}
+	}
+
+	keys := append([]*types.IdempotencyKey{}, m.keys...)
+	sortKeys(keys)
+	for _, record := range keys {
+		if changed(kindKey, record.Key) {
+			snap.keys = append(snap.keys, *record)
+		}
+	}
+
+	// the base has no records to delete.
+	if seq == 0 {
+		return snap, nil
+	}
+	for _, kind := range recordKinds {
+		for id, c := range m.changed[kind] {
+			if c.deleted && c.seq > seq {
+				snap.increment.deleted[kind] = append(snap.increment.deleted[kind], id)
+			}
+		}
+		sort.Strings(snap.increment.deleted[kind])
+	}
+	return snap, nil
+}
+
+// compact - forgets the commits which changed the records up to
+// the checkpoint, and the records deleted up to it.
+func (m *MemoryStorage) compact(checkpoint string) error {
+	seq, err := m.since(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	for _, changes := range m.changed {
+		for id, c := range changes {
+			if c.seq <= seq {
+				delete(changes, id)
+			}
+		}
+	}
+	if seq > m.compacted {
+		m.compacted = seq
+	}
+	return nil
+}
+
+// encode - returns the increment entry of the archive.
+func (inc *increment) encode(nextAccountID int64) []byte {
+	records := []string{"checkpoint;" + escapeField(inc.from) + ";" + escapeField(inc.to) + ";" + strconv.FormatInt(nextAccountID, 10)}
+	for _, kind := range recordKinds {
+		for _, id := range inc.deleted[kind] {
+			records = append(records, "deleted;"+string(kind)+";"+escapeField(id))
+		}
+	}
+	return encodeDump(records)
+}
+
+// readIncrement - reads the increment entry of the archive to the snapshot,
+// the entry which can't be read is returned as the error.
+func (snap *snapshot) readIncrement(data []byte, codec dumpCodec) *ImportError {
+	data, ferr := codec.open(data)
+	if ferr == nil {
+		ferr = snap.decodeIncrement(data)
+	}
+	if ferr != nil {
+		ferr.File = incrementFile
+		return ferr
+	}
+	return nil
+}
+
+// decodeIncrement - decodes the lines of the increment entry.
+func (snap *snapshot) decodeIncrement(data []byte) *ImportError {
+	lines, version, ferr := decodeDump(data)
+	if ferr != nil {
+		return ferr
+	}
+
+	inc := &increment{deleted: make(map[recordKind][]string)}
+	found := false
+	for _, line := range lines {
+		fields := splitFields(version, line.text)
+		switch {
+		case fields[0] == "checkpoint" && len(fields) == 4 && !found:
+			id, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return &ImportError{Line: line.number, Field: "next_account_id", Reason: fmt.Sprintf("%q is not a number", fields[3]), Err: ErrMalformedRecord}
+			}
+			inc.from, inc.to, snap.nextAccountID = fields[1], fields[2], id
+			found = true
+		case fields[0] == "deleted" && len(fields) == 3:
+			kind := recordKind(fields[1])
+			if !isRecordKind(kind) || kind == kindKey {
+				return &ImportError{Line: line.number, Field: "kind", Reason: fmt.Sprintf("%q can't be deleted", kind), Err: ErrMalformedRecord}
+			}
+			if _, err := strconv.ParseInt(fields[2], 10, 64); kind == kindAccount && err != nil {
+				return &ImportError{Line: line.number, Field: "id", Reason: fmt.Sprintf("%q is not a number", fields[2]), Err: ErrMalformedRecord}
+			}
+			inc.deleted[kind] = append(inc.deleted[kind], fields[2])
+		default:
+			return &ImportError{Line: line.number, Reason: fmt.Sprintf("unexpected line %q", line.text), Err: ErrMalformedRecord}
+		}
+	}
+
+	if !found {
+		return &ImportError{Reason: "the checkpoint is missing", Err: ErrMalformedRecord}
+	}
+	snap.increment = inc
+	return nil
+}
+
+// encodeState - returns the dump file of the checkpoints of the storage:
+//
+//	storage;<epoch>;<number of the commits>;<compacted up to>;<last increment imported>
+//	changed;<kind>;<ID>;<commit which changed the record last>;<1 if deleted>
+func (m *MemoryStorage) encodeState() []byte {
+	records := []string{"storage;" + escapeField(m.epoch) + ";" + strconv.FormatUint(m.seq, 10) + ";" +
+		strconv.FormatUint(m.compacted, 10) + ";" + escapeField(m.lastIncrement)}
+	for _, kind := range recordKinds {
+		ids := make([]string, 0, len(m.changed[kind]))
+		for id := range m.changed[kind] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			c := m.changed[kind][id]
+			deleted := "0"
+			if c.deleted {
+				deleted = "1"
+			}
+			records = append(records, "changed;"+string(kind)+";"+escapeField(id)+";"+strconv.FormatUint(c.seq, 10)+";"+deleted)
+		}
+	}
+	return encodeDump(records)
+}
+
+// restoreState - restores the checkpoints of the storage written by
+// encodeState, the file which can't be read is returned as the error.
+func (m *MemoryStorage) restoreState(data []byte) *ImportError {
+	lines, version, ferr := decodeDump(data)
+	if ferr != nil {
+		return ferr
+	}
+
+	number := func(line dumpLine, name string, field string) (uint64, *ImportError) {
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, &ImportError{Line: line.number, Field: name, Reason: fmt.Sprintf("%q is not a number", field), Err: ErrMalformedRecord}
+		}
+		return n, nil
+	}
+
+	found := false
+	changed := make(map[recordKind]map[string]recordChange)
+	for _, line := range lines {
+		fields := splitFields(version, line.text)
+		switch {
+		case fields[0] == "storage" && len(fields) == 5 && !found:
+			seq, ferr := number(line, "seq", fields[2])
+			if ferr != nil {
+				return ferr
+			}
+			compacted, ferr := number(line, "compacted", fields[3])
+			if ferr != nil {
+				return ferr
+			}
+			m.epoch, m.seq, m.compacted, m.lastIncrement = fields[1], seq, compacted, fields[4]
+			found = true
+		case fields[0] == "changed" && len(fields) == 5 && isRecordKind(recordKind(fields[1])):
+			seq, ferr := number(line, "seq", fields[3])
+			if ferr != nil {
+				return ferr
+			}
+			kind := recordKind(fields[1])
+			if changed[kind] == nil {
+				changed[kind] = make(map[string]recordChange)
+			}
+			changed[kind][fields[2]] = recordChange{seq: seq, deleted: fields[4] == "1"}
+		default:
+			return &ImportError{Line: line.number, Reason: fmt.Sprintf("unexpected line %q", line.text), Err: ErrMalformedRecord}
+		}
+	}
+
+	if !found {
+		return &ImportError{Reason: "the checkpoint is missing", Err: ErrMalformedRecord}
+	}
+	m.changed = changed
+	return nil
+}
@@ -0,0 +1,286 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestService_ExportIncrement_chain(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	paths := []string{}
+	checkpoint := ""
+	export := func() {
+		path := filepath.Join(dir, "increment"+strconv.Itoa(len(paths))+".tar")
+		next, err := s.ExportIncrementToFile(path, checkpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkpoint = next
+		paths = append(paths, path)
+	}
+
+	export()
+
+	payment, err := s.Pay(2, 20, "rent")
+	if err == nil {
+		_, err = s.FavoritePayment(payment.ID, "my rent")
+	}
+	if err == nil {
+		_, err = s.RegisterAccount("4444")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	export()
+
+	err = s.Reject(payment.ID)
+	if err == nil {
+		err = s.Deposit(4, 100)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	export()
+
+	imported := newTestService()
+	imported.SetImportMode(ImportStrict)
+	err = imported.ImportIncrements(paths...)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(takeSnapshot(imported.store()), takeSnapshot(s.store())) {
+		t.Errorf("ImportIncrements(): wrong records imported")
+	}
+
+	if imported.nextAccountID != s.nextAccountID {
+		t.Errorf("ImportIncrements(): wrong nextAccountID = %v, want %v", imported.nextAccountID, s.nextAccountID)
+	}
+
+	err = imported.VerifyJournal()
+	if err != nil {
+		t.Errorf("ImportIncrements(): journal doesn't match the balances, error = %v", err)
+	}
+}
+
+func TestService_ExportIncrement_changedOnly(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	checkpoint, err := s.ExportIncrement(&bytes.Buffer{}, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(1, 5, "food")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the payment is deleted from the storage directly, the service never does it.
+	first := s.store().Payments()[0].ID
+	err = s.update(func(tx Tx) error {
+		tx.DeletePayment(first)
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	next, err := s.ExportIncrement(buf, checkpoint)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if next == checkpoint {
+		t.Errorf("ExportIncrement(): checkpoint isn't moved = %v", next)
+	}
+
+	snap, errs, err := readArchive(buf, dumpCodec{})
+	if err != nil || errs != nil {
+		t.Errorf("ExportIncrement(): broken archive, error = %v %v", err, errs)
+		return
+	}
+
+	if len(snap.accounts) != 1 || snap.accounts[0].ID != 1 {
+		t.Errorf("ExportIncrement(): wrong accounts = %v", snap.accounts)
+	}
+	if len(snap.payments) != 1 || snap.payments[0].ID != payment.ID {
+		t.Errorf("ExportIncrement(): wrong payments = %v", snap.payments)
+	}
+	if len(snap.favorites) != 0 {
+		t.Errorf("ExportIncrement(): wrong favorites = %v", snap.favorites)
+	}
+	if !reflect.DeepEqual(snap.increment.deleted, map[recordKind][]string{kindPayment: {first}}) {
+		t.Errorf("ExportIncrement(): wrong deleted records = %v", snap.increment.deleted)
+	}
+	if snap.increment.from != checkpoint || snap.increment.to != next {
+		t.Errorf("ExportIncrement(): wrong checkpoints = %v -> %v", snap.increment.from, snap.increment.to)
+	}
+
+	// nothing is changed since the last checkpoint.
+	buf.Reset()
+	_, err = s.ExportIncrement(buf, next)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	snap, _, _ = readArchive(buf, dumpCodec{})
+	if len(snap.accounts)+len(snap.payments)+len(snap.postings) != 0 {
+		t.Errorf("ExportIncrement(): unchanged records exported = %v %v", snap.accounts, snap.payments)
+	}
+}
+
+func TestService_ImportIncrement_outOfOrder(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	increments := []*bytes.Buffer{}
+	checkpoint := ""
+	for i := 0; i < 3; i++ {
+		s.Pay(1, 1, "food")
+		buf := &bytes.Buffer{}
+		next, err := s.ExportIncrement(buf, checkpoint)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		increments = append(increments, buf)
+		checkpoint = next
+	}
+
+	imported := newTestService()
+	err := imported.ImportIncrement(bytes.NewReader(increments[1].Bytes()))
+	if !errors.Is(err, ErrIncrementOutOfOrder) {
+		t.Errorf("ImportIncrement(): must return ErrIncrementOutOfOrder without the base, returned = %v", err)
+	}
+
+	err = imported.ImportIncrement(increments[0])
+	if err == nil {
+		err = imported.ImportIncrement(bytes.NewReader(increments[2].Bytes()))
+	}
+	if !errors.Is(err, ErrIncrementOutOfOrder) {
+		t.Errorf("ImportIncrement(): must return ErrIncrementOutOfOrder for the skipped increment, returned = %v", err)
+	}
+
+	if len(imported.store().Payments()) != len(s.store().Payments())-2 {
+		t.Errorf("ImportIncrement(): wrong payments imported = %v", len(imported.store().Payments()))
+	}
+
+	dump := &bytes.Buffer{}
+	s.ExportDump(dump)
+	err = imported.ImportIncrement(dump)
+	if !errors.Is(err, ErrMalformedRecord) {
+		t.Errorf("ImportIncrement(): must return ErrMalformedRecord for the whole dump, returned = %v", err)
+	}
+}
+
+func TestService_ExportIncrement_unknownCheckpoint(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	other := newTestService()
+	foreign, err := other.ExportIncrement(&bytes.Buffer{}, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	current, _ := s.ExportIncrement(&bytes.Buffer{}, "")
+	for _, checkpoint := range []string{foreign, "broken", current + "0", s.memory().epoch + ":x"} {
+		buf := &bytes.Buffer{}
+		_, err := s.ExportIncrement(buf, checkpoint)
+		if !errors.Is(err, ErrUnknownCheckpoint) {
+			t.Errorf("ExportIncrement(%q): must return ErrUnknownCheckpoint, returned = %v", checkpoint, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("ExportIncrement(%q): written with unknown checkpoint", checkpoint)
+		}
+	}
+}
+
+func TestService_CompactIncrements(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	base, err := s.ExportIncrement(&bytes.Buffer{}, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	first := s.store().Payments()[0].ID
+	err = s.update(func(tx Tx) error {
+		tx.DeletePayment(first)
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	checkpoint, err := s.ExportIncrement(&bytes.Buffer{}, base)
+	if err == nil {
+		_, err = s.Pay(1, 5, "food")
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.CompactIncrements(checkpoint)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// only the payment, its account and posting are remembered after the compaction.
+	changes := 0
+	for _, changed := range s.memory().changed {
+		changes += len(changed)
+	}
+	if changes != 3 {
+		t.Errorf("CompactIncrements(): wrong changes left = %v", s.memory().changed)
+	}
+
+	_, err = s.ExportIncrement(&bytes.Buffer{}, base)
+	if !errors.Is(err, ErrUnknownCheckpoint) {
+		t.Errorf("ExportIncrement(): must return ErrUnknownCheckpoint for the compacted one, returned = %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	_, err = s.ExportIncrement(buf, checkpoint)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	snap, _, _ := readArchive(buf, dumpCodec{})
+	if len(snap.payments) != 1 || len(snap.accounts) != 1 || len(snap.increment.deleted) != 0 {
+		t.Errorf("ExportIncrement(): wrong increment after the compaction = %v %v", snap.payments, snap.increment.deleted)
+	}
+
+	// the base has all records still.
+	buf.Reset()
+	_, err = s.ExportIncrement(buf, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	snap, _, _ = readArchive(buf, dumpCodec{})
+	if !reflect.DeepEqual(snap.payments, takeSnapshot(s.store()).payments) {
+		t.Errorf("ExportIncrement(): wrong base after the compaction = %v", snap.payments)
+	}
+}
@@ -0,0 +1,334 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// JSONVersion - the version of the JSON document written by ExportJSON.
+//
+// The document looks like:
+//
+//	{
+//	"version": 1,
+//	"next_account_id": <ID of the last registered account>,
+//	"accounts": [<account>, ...],
+//	"payments": [...],
+//	"favorites": [...],
+//	"transfers": [...],
+//	"deposits": [...],
+//	"journal": [...],
+//	"idempotency": [...]
+//	}
+//
+// the records are encoded with the JSON tags of the types package.
+const JSONVersion = 1
+
+// Names of the members of the JSON document besides the records.
+const (
+	jsonVersion       = "version"
+	jsonNextAccountID = "next_account_id"
+)
+
+// ExportJSON - writes the whole state of the wallet as a JSON document.
+// The records are encoded one by one, so the document is never held
+// in memory as a whole.
+func (s *Service) ExportJSON(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	err := s.writeJSON(w)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	return nil
+}
+
+// writeJSON - writes the JSON document of the storage.
+func (s *Service) writeJSON(w io.Writer) error {
+	store := s.store()
+	buf := bufio.NewWriter(w)
+
+	_, err := fmt.Fprintf(buf, "{\n%q: %d,\n%q: %d", jsonVersion, JSONVersion, jsonNextAccountID, s.nextAccountID)
+	if err != nil {
+		return err
+	}
+
+	// expired idempotency keys are not worth keeping.
+	keys := []*types.IdempotencyKey{}
+	for _, record := range store.IdempotencyKeys() {
+		if !s.keyExpired(record) {
+			keys = append(keys, record)
+		}
+	}
+	sortKeys(keys)
+
+	accounts := store.Accounts()
+	payments := store.Payments()
+	favorites := store.Favorites()
+	transfers := store.Transfers()
+	deposits := store.Deposits()
+	postings := store.Postings()
+
+	for _, kind := range recordKinds {
+		var count int
+		var record func(i int) interface{}
+		switch kind {
+		case kindAccount:
+			count, record = len(accounts), func(i int) interface{} { return accounts[i] }
+		case kindPayment:
+			count, record = len(payments), func(i int) interface{} { return payments[i] }
+		case kindFavorite:
+			count, record = len(favorites), func(i int) interface{} { return favorites[i] }
+		case kindTransfer:
+			count, record = len(transfers), func(i int) interface{} { return transfers[i] }
+		case kindDeposit:
+			count, record = len(deposits), func(i int) interface{} { return deposits[i] }
+		case kindPosting:
+			count, record = len(postings), func(i int) interface{} { return postings[i] }
+		case kindKey:
+			count, record = len(keys), func(i int) interface{} { return keys[i] }
+		}
+
+		err = writeJSONArray(buf, kind, count, record)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = buf.WriteString("\n}\n")
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// writeJSONArray - writes the member of the JSON document with
+// the array of the records of the kind.
+func writeJSONArray(w *bufio.Writer, kind recordKind, count int, record func(i int) interface{}) error {
+	_, err := fmt.Fprintf(w, ",\n%q: [", kind)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		data, err := json.Marshal(record(i))
+		if err != nil {
+			return err
+		}
+
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString("\n")
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.WriteString("\n]")
+	return err
+}
+
+// ImportJSON - import(reads) the state of the wallet written by ExportJSON.
+// The records are decoded one by one and merged the same way as by Import.
+//
+// The records which can't be decoded are treated according to the import
+// mode, their errors hold the member of the document as the file and
+// the number of the record in it as the line. The document which isn't
+// a valid JSON is not imported at all.
+func (s *Service) ImportJSON(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, errs, err := readJSON(r)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	return s.importSnapshot(snap, errs)
+}
+
+// readJSON - reads the JSON document. The records which can't be decoded
+// are skipped and returned as the errors, the broken document is returned
+// as the error.
+func readJSON(r io.Reader) (*snapshot, ImportErrors, error) {
+	snap := newSnapshot()
+	snap.stream = true
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	malformed := func(member string, err error) *ImportError {
+		return &ImportError{File: member, Reason: err.Error(), Err: ErrMalformedRecord}
+	}
+
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return nil, nil, malformed("json", err)
+	}
+
+	var errs ImportErrors
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, nil, malformed("json", err)
+		}
+		member, _ := token.(string)
+
+		switch member {
+		case jsonVersion:
+			var version int
+			err = dec.Decode(&version)
+			if err != nil {
+				return nil, nil, malformed(member, err)
+			}
+			if version < 1 || version > JSONVersion {
+				return nil, nil, &ImportError{
+					File:   member,
+					Reason: fmt.Sprintf("version %d, supported up to %d", version, JSONVersion),
+					Err:    ErrUnsupportedVersion,
+				}
+			}
+
+		case jsonNextAccountID:
+			err = dec.Decode(&snap.nextAccountID)
+			if err != nil {
+				return nil, nil, malformed(member, err)
+			}
+
+		default:
+			kind := recordKind(member)
+			if !isRecordKind(kind) {
+				// the members added by the later versions are skipped.
+				var skipped json.RawMessage
+				err = dec.Decode(&skipped)
+				if err != nil {
+					return nil, nil, malformed(member, err)
+				}
+				continue
+			}
+
+			err = expectDelim(dec, '[')
+			if err != nil {
+				return nil, nil, malformed(member, err)
+			}
+			snap.found[kind] = true
+
+			for line := 1; dec.More(); line++ {
+				ierr, err := snap.decodeJSON(dec, kind)
+				if err != nil {
+					return nil, nil, &ImportError{File: member, Line: line, Reason: err.Error(), Err: ErrMalformedRecord}
+				}
+				if ierr != nil {
+					ierr.File = member
+					ierr.Line = line
+					errs = append(errs, ierr)
+					continue
+				}
+				snap.lines[kind] = append(snap.lines[kind], line)
+			}
+
+			err = expectDelim(dec, ']')
+			if err != nil {
+				return nil, nil, malformed(member, err)
+			}
+		}
+	}
+
+	err = expectDelim(dec, '}')
+	if err != nil {
+		return nil, nil, malformed("json", err)
+	}
+	return snap, errs, nil
+}
+
+// decodeJSON - adds the next record of the kind read from the decoder.
+// The record of the wrong type is returned as the first error without
+// its position, the broken document - as the second one.
+func (snap *snapshot) decodeJSON(dec *json.Decoder, kind recordKind) (*ImportError, error) {
+	var record interface{}
+	switch kind {
+	case kindAccount:
+		record = &types.Account{}
+	case kindPayment:
+		record = &types.Payment{}
+	case kindFavorite:
+		record = &types.Favorite{}
+	case kindTransfer:
+		record = &types.Transfer{}
+	case kindDeposit:
+		record = &types.Deposit{}
+	case kindPosting:
+		record = &types.Posting{}
+	case kindKey:
+		record = &types.IdempotencyKey{}
+	}
+
+	// the broken document can't be read further, while the record
+	// of the wrong type is just skipped.
+	var raw json.RawMessage
+	err := dec.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(raw, record)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr):
+		return &ImportError{
+			Field:  typeErr.Field,
+			Reason: fmt.Sprintf("%s is not %s", typeErr.Value, typeErr.Type),
+			Err:    ErrMalformedRecord,
+		}, nil
+	case err != nil:
+		return &ImportError{Reason: err.Error(), Err: ErrMalformedRecord}, nil
+	}
+
+	switch record := record.(type) {
+	case *types.Account:
+		snap.accounts = append(snap.accounts, *record)
+	case *types.Payment:
+		snap.payments = append(snap.payments, *record)
+	case *types.Favorite:
+		snap.favorites = append(snap.favorites, *record)
+	case *types.Transfer:
+		snap.transfers = append(snap.transfers, *record)
+	case *types.Deposit:
+		snap.deposits = append(snap.deposits, *record)
+	case *types.Posting:
+		snap.postings = append(snap.postings, *record)
+	case *types.IdempotencyKey:
+		snap.keys = append(snap.keys, *record)
+	}
+	return nil, nil
+}
+
+// expectDelim - reads the next token, which must be the delimiter.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %q, got %q", string(delim), fmt.Sprint(token))
+	}
+	return nil
+}
+
+// isRecordKind - reports whether the kind is one of the recordKinds.
+func isRecordKind(kind recordKind) bool {
+	for _, known := range recordKinds {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
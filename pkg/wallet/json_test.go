@@ -0,0 +1,157 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestService_ExportJSON_roundTrip(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	payment, err := s.Pay(2, 20, "rent; \"March\"\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.FavoritePayment(payment.ID, "my rent")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Transfer(1, 3, 50)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.ExportJSON(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !json.Valid(buf.Bytes()) {
+		t.Errorf("ExportJSON(): invalid document = %s", buf)
+		return
+	}
+
+	if !strings.Contains(buf.String(), `"account_id":2`) {
+		t.Errorf("ExportJSON(): fields are not tagged = %s", buf)
+	}
+
+	imported := newTestService()
+	imported.SetImportMode(ImportStrict)
+	err = imported.ImportJSON(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(takeSnapshot(imported.store()), takeSnapshot(s.store())) {
+		t.Errorf("ImportJSON(): wrong records imported")
+	}
+
+	if imported.nextAccountID != s.nextAccountID {
+		t.Errorf("ImportJSON(): wrong nextAccountID = %v, want %v", imported.nextAccountID, s.nextAccountID)
+	}
+
+	err = imported.VerifyJournal()
+	if err != nil {
+		t.Errorf("ImportJSON(): journal doesn't match the balances, error = %v", err)
+	}
+}
+
+func TestService_ImportJSON_nextAccountID(t *testing.T) {
+	s := newTestService()
+	err := s.ImportJSON(strings.NewReader(`{"next_account_id": 10, "accounts": [{"id": 4, "phone": "+4444", "balance": 0}]}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := s.RegisterAccount("+1111")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if account.ID != 11 {
+		t.Errorf("ImportJSON(): wrong ID of the next account = %v", account.ID)
+	}
+}
+
+func TestService_ImportJSON_badRecords(t *testing.T) {
+	document := `{
+		"version": 1,
+		"accounts": [
+			{"id": 1, "phone": "+1111", "balance": "abc"},
+			{"id": 2, "phone": "+2222", "balance": 100}
+		],
+		"payments": [
+			{"id": "p1", "account_id": 2, "amount": 10, "category": "auto", "status": "DONE"},
+			{"id": "p2", "account_id": 2, "amount": 10, "category": "auto", "status": "OK", "created": "yesterday"}
+		],
+		"unknown": {"skipped": true}
+	}`
+
+	want := []ImportError{
+		{File: "accounts", Line: 1, Field: "balance"},
+		{File: "payments", Line: 2, Field: ""},
+		{File: "payments", Line: 1, Field: "status"},
+	}
+
+	s := newTestService()
+	err := s.ImportJSON(strings.NewReader(document))
+
+	var errs ImportErrors
+	if !errors.As(err, &errs) || len(errs) != len(want) {
+		t.Errorf("ImportJSON(): wrong errors = %v", err)
+		return
+	}
+
+	for i, err := range errs {
+		if err.File != want[i].File || err.Line != want[i].Line || err.Field != want[i].Field {
+			t.Errorf("ImportJSON(): wrong error = %v, want %v:%v field %v", err, want[i].File, want[i].Line, want[i].Field)
+		}
+	}
+
+	if len(s.store().Accounts()) != 1 || len(s.store().Payments()) != 0 {
+		t.Errorf("ImportJSON(): wrong records imported")
+	}
+
+	strict := newTestService()
+	strict.SetImportMode(ImportStrict)
+	err = strict.ImportJSON(strings.NewReader(document))
+	if !errors.Is(err, ErrMalformedRecord) || len(strict.store().Accounts()) != 0 {
+		t.Errorf("ImportJSON(): must import nothing in strict mode, error = %v", err)
+	}
+}
+
+func TestService_ImportJSON_broken(t *testing.T) {
+	documents := map[string]error{
+		`{"accounts": [{"id": 1, "phone": "+1111", "balance": 0}, {"id": 2,`: ErrMalformedRecord,
+		`{"accounts": {"id": 1}}`: ErrMalformedRecord,
+		`[]`:                      ErrMalformedRecord,
+		`{"version": 2, "accounts": [{"id": 1, "phone": "+1111", "balance": 0}]}`: ErrUnsupportedVersion,
+	}
+
+	for document, want := range documents {
+		s := newTestService()
+		err := s.ImportJSON(strings.NewReader(document))
+		if !errors.Is(err, want) {
+			t.Errorf("ImportJSON(%s): must return %v, returned = %v", document, want, err)
+		}
+
+		if len(s.store().Accounts()) != 0 {
+			t.Errorf("ImportJSON(%s): broken document imported", document)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package wallet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SardorMS/wallet/pkg/types"
+	"github.com/google/uuid"
+)
+
+// debit - the debit line of the posting.
+func debit(account types.LedgerAccount, amount types.Money) types.Line {
+	return types.Line{Account: account, Debit: amount}
+}
+
+// credit - the credit line of the posting.
+func credit(account types.LedgerAccount, amount types.Money) types.Line {
+	return types.Line{Account: account, Credit: amount}
+}
+
+// post - adds the balanced posting to the transaction together with
+// the balances of the customer accounts changed by its lines. Every change
+// of a balance made by the service goes through it.
+func (s *Service) post(tx Tx, kind types.EntryType, reference string, created time.Time, lines ...types.Line) error {
+	var debits, credits types.Money
+	accounts := make(map[int64]types.Account)
+	order := []int64{}
+	for _, line := range lines {
+		debits += line.Debit
+		credits += line.Credit
+
+		id, ok := line.Account.AccountID()
+		if !ok {
+			continue
+		}
+
+		account, seen := accounts[id]
+		if !seen {
+			stored, err := s.store().Account(id)
+			if err != nil {
+				return err
+			}
+			account = *stored
+			order = append(order, id)
+		}
+		account.Balance += line.Credit - line.Debit
+		accounts[id] = account
+	}
+
+	if debits != credits {
+		return ErrUnbalancedPosting
+	}
+
+	tx.SavePosting(types.Posting{
+		ID:        uuid.New().String(),
+		Type:      kind,
+		Reference: reference,
+		Created:   created,
+		Lines:     lines,
+	})
+
+	for _, id := range order {
+		tx.SaveAccount(accounts[id])
+	}
+	return nil
+}
+
+// postingAccounts - returns the IDs of the customer accounts the posting
+// refers to, each of them once.
+func postingAccounts(posting types.Posting) []int64 {
+	ids := []int64{}
+	for i, line := range posting.Lines {
+		if id, ok := line.Account.AccountID(); ok && !lineSeen(posting.Lines[:i], line.Account) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// lineSeen - reports whether one of the lines refers to the account.
+func lineSeen(lines []types.Line, account types.LedgerAccount) bool {
+	for _, line := range lines {
+		if line.Account == account {
+			return true
+		}
+	}
+	return false
+}
+
+// openBalances - posts an opening entry for every account whose balance
+// was loaded from outside and isn't explained by the journal.
+func (s *Service) openBalances(tx Tx) error {
+	for _, account := range s.store().Accounts() {
+		ledger := types.CustomerLedger(account.ID)
+		diff := account.Balance - s.store().LedgerBalance(ledger)
+		if diff == 0 {
+			continue
+		}
+
+		lines := []types.Line{debit(types.LedgerExternalFunding, diff), credit(ledger, diff)}
+		if diff < 0 {
+			lines = []types.Line{debit(ledger, -diff), credit(types.LedgerExternalFunding, -diff)}
+		}
+
+		tx.SavePosting(types.Posting{
+			ID:      uuid.New().String(),
+			Type:    types.EntryOpening,
+			Created: s.now(),
+			Lines:   lines,
+		})
+	}
+	return nil
+}
+
+// journalBalances - returns the function which sets the balances of the
+// accounts of the snapshot(and the ones its postings refer to) to the
+// balances of the journal. The postings held in memory which involve the
+// accounts kept from memory stay with the ones of the file, so the balances
+// of the file may not take them into account.
+func (s *Service) journalBalances(snap *snapshot) func(tx Tx) error {
+	seen := make(map[int64]bool)
+	ids := []int64{}
+	add := func(id int64) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	for _, account := range snap.accounts {
+		add(account.ID)
+	}
+	for _, posting := range snap.postings {
+		for _, id := range postingAccounts(posting) {
+			add(id)
+		}
+	}
+
+	return func(tx Tx) error {
+		for _, id := range ids {
+			account, err := s.store().Account(id)
+			if err != nil {
+				continue
+			}
+
+			balance := s.store().LedgerBalance(types.CustomerLedger(id))
+			if account.Balance != balance {
+				updated := *account
+				updated.Balance = balance
+				tx.SaveAccount(updated)
+			}
+		}
+		return nil
+	}
+}
+
+// AccountHistory - returns all credits and debits of the account
+// in the order they were made, with the balance after each of them.
+func (s *Service) AccountHistory(accountID int64) ([]types.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err := s.store().Account(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	ledger := types.CustomerLedger(accountID)
+	balance := types.Money(0)
+	entries := []types.Entry{}
+	for _, posting := range s.store().PostingsByLedger(ledger) {
+		for _, line := range posting.Lines {
+			if line.Account != ledger {
+				continue
+			}
+
+			amount := line.Credit - line.Debit
+			balance += amount
+			entries = append(entries, types.Entry{
+				ID:        posting.ID,
+				AccountID: accountID,
+				Type:      entryType(posting.Type, amount),
+				Amount:    amount,
+				Balance:   balance,
+				Reference: posting.Reference,
+				Created:   posting.Created,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// entryType - the type of the posting as seen from one of its accounts.
+func entryType(kind types.EntryType, amount types.Money) types.EntryType {
+	switch kind {
+	case types.EntryTransfer:
+		if amount > 0 {
+			return types.EntryTransferIn
+		}
+		return types.EntryTransferOut
+	case types.EntryReversal:
+		if amount > 0 {
+			return types.EntryRefund
+		}
+		return types.EntryReversal
+	}
+	return kind
+}
+
+// JournalBalance - returns the balance of the account computed from the journal.
+func (s *Service) JournalBalance(accountID int64) (types.Money, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err := s.store().Account(accountID)
+	if err != nil {
+		return 0, err
+	}
+	return s.store().LedgerBalance(types.CustomerLedger(accountID)), nil
+}
+
+// LedgerBalance - returns the balance of any journal account,
+// including the system ones.
+func (s *Service) LedgerBalance(account types.LedgerAccount) types.Money {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store().LedgerBalance(account)
+}
+
+// VerifyJournal - checks that every posting is balanced and the balance
+// of every account is equal to the one computed from the journal.
+func (s *Service) VerifyJournal() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, posting := range s.store().Postings() {
+		var debits, credits types.Money
+		for _, line := range posting.Lines {
+			debits += line.Debit
+			credits += line.Credit
+		}
+		if debits != credits {
+			return fmt.Errorf("%w: posting %s", ErrUnbalancedPosting, posting.ID)
+		}
+	}
+
+	for _, account := range s.store().Accounts() {
+		balance := s.store().LedgerBalance(types.CustomerLedger(account.ID))
+		if account.Balance != balance {
+			return fmt.Errorf("%w: account %d has %d, journal %d",
+				ErrBalanceMismatch, account.ID, account.Balance, balance)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+func TestService_post_unbalanced(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	err := s.update(func(tx Tx) error {
+		return s.post(tx, types.EntryDeposit, "", testTime,
+			debit(types.LedgerExternalFunding, 100),
+			credit(types.CustomerLedger(1), 50))
+	})
+	if err != ErrUnbalancedPosting {
+		t.Errorf("post(): must return ErrUnbalancedPosting, returned = %v", err)
+	}
+
+	account, _ := s.FindAccountByID(1)
+	if account.Balance != 250 {
+		t.Errorf("post(): balance changed by unbalanced posting = %v", account)
+	}
+}
+
+func TestService_LedgerBalance(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	payment, err := s.Pay(2, 60, "food")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Transfer(1, 3, 20)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if balance := s.LedgerBalance(types.LedgerExternalFunding); balance != -1000 {
+		t.Errorf("LedgerBalance(): wrong external funding balance = %v", balance)
+	}
+
+	if balance := s.LedgerBalance(types.LedgerMerchantClearing); balance != 363 {
+		t.Errorf("LedgerBalance(): wrong merchant clearing balance = %v", balance)
+	}
+
+	// every posting is balanced, so all accounts together sum up to zero.
+	total := types.Money(0)
+	for _, balance := range s.memory().ledgerBalances {
+		total += balance
+	}
+	if total != 0 {
+		t.Errorf("LedgerBalance(): journal isn't balanced, total = %v", total)
+	}
+}
+
+func TestService_JournalBalance(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	balance, err := s.JournalBalance(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if balance != 250 {
+		t.Errorf("JournalBalance(): wrong balance = %v", balance)
+	}
+
+	_, err = s.JournalBalance(4)
+	if err != ErrAccountNotFound {
+		t.Errorf("JournalBalance(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
+
+func TestService_VerifyJournal_success(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	transfer, err := s.Transfer(1, 2, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.RejectTransfer(transfer.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.VerifyJournal()
+	if err != nil {
+		t.Errorf("VerifyJournal(): error = %v", err)
+	}
+}
+
+func TestService_VerifyJournal_mismatch(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	// the balance is changed behind the journal.
+	s.memory().accountsByID[2].Balance += 10
+
+	err := s.VerifyJournal()
+	if !errors.Is(err, ErrBalanceMismatch) {
+		t.Errorf("VerifyJournal(): must return ErrBalanceMismatch, returned = %v", err)
+	}
+}
+
+func TestService_Import_openBalances(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/accounts.dump", []byte("1;+1111;400\n2;+2222;0\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	s.SetClock(testClock(testTime))
+	err = s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.VerifyJournal()
+	if err != nil {
+		t.Errorf("Import(): journal doesn't match the balances, error = %v", err)
+	}
+
+	entries, err := s.AccountHistory(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(entries) != 1 || entries[0].Type != types.EntryOpening || entries[0].Balance != 400 {
+		t.Errorf("Import(): wrong opening entries = %v", entries)
+	}
+
+	entries, _ = s.AccountHistory(2)
+	if len(entries) != 0 {
+		t.Errorf("Import(): opening entry for empty account = %v", entries)
+	}
+}
@@ -0,0 +1,196 @@
+package wallet
+
+import (
+	"context"
+	"sync"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// Query - the parallel query over the payments. The payments are split
+// into contiguous parts, one per worker; every worker filters the payments
+// of its part, maps them to the values and reduces the values to the
+// result of the part. The results of the parts are merged in the order
+// of the parts, so the result doesn't depend on the scheduling.
+type Query struct {
+	// Workers - the number of the workers, 1 if less.
+	Workers int
+
+	// Filter - selects the payments of the query, all of them if nil.
+	Filter func(payment types.Payment) bool
+
+	// Map - turns the payment into the value. If nil, the value is
+	// the payment itself as *types.Payment, which must not be changed.
+	Map func(payment types.Payment) interface{}
+
+	// Init - returns the initial result of the part, nil if not set.
+	// It is called for every part, so it returns a new one every time.
+	Init func() interface{}
+
+	// Reduce - adds the value to the result of the part and returns it.
+	// If nil, the result is []interface{} with all values in the order
+	// of the payments, Init and Merge are not used then.
+	Reduce func(result interface{}, value interface{}) interface{}
+
+	// Merge - adds the result of the next part to the result of the
+	// previous ones and returns it. If nil, Reduce is used: the results
+	// and the values must be of the same type then.
+	Merge func(result interface{}, next interface{}) interface{}
+}
+
+// QueryPayments - runs the query over the copies of all payments and
+// returns its result. The functions of the query are called without
+// holding the lock, so they are free to call the methods of the service.
+//
+// When the context is done, ctx.Err() is returned at once and the workers
+// stop before the next payment; the calls already made are not interrupted.
+func (s *Service) QueryPayments(ctx context.Context, query Query) (interface{}, error) {
+	s.mu.RLock()
+	stored := s.store().Payments()
+	all := make([]types.Payment, len(stored))
+	payments := make([]*types.Payment, len(stored))
+	for i, payment := range stored {
+		all[i] = *payment
+		payments[i] = &all[i]
+	}
+	s.mu.RUnlock()
+
+	return query.run(ctx, payments, true)
+}
+
+// run - runs the query over the payments. The workers which are left
+// behind on cancellation(detach) finish by themselves, so the payments
+// must not be the ones of the storage then.
+func (q Query) run(ctx context.Context, payments []*types.Payment, detach bool) (interface{}, error) {
+	init, reduce, merge := q.Init, q.Reduce, q.Merge
+	if reduce == nil {
+		init, reduce, merge = collectInit, collectReduce, collectMerge
+	}
+	if init == nil {
+		init = func() interface{} { return nil }
+	}
+	if merge == nil {
+		merge = reduce
+	}
+
+	workers := q.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	size := (len(payments) + workers - 1) / workers
+	parts := [][]*types.Payment{}
+	for low := 0; low < len(payments); low += size {
+		high := low + size
+		if high > len(payments) {
+			high = len(payments)
+		}
+		parts = append(parts, payments[low:high])
+	}
+
+	// every worker puts the result of its part to its own place.
+	results := make([]interface{}, len(parts))
+	done := ctx.Done()
+	wg := sync.WaitGroup{}
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part []*types.Payment) {
+			defer wg.Done()
+			result := init()
+			for _, payment := range part {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if q.Filter != nil && !q.Filter(*payment) {
+					continue
+				}
+
+				var value interface{} = payment
+				if q.Map != nil {
+					value = q.Map(*payment)
+				}
+				result = reduce(result, value)
+			}
+			results[i] = result
+		}(i, part)
+	}
+
+	if detach {
+		err := waitContext(ctx, &wg)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(results) == 0 {
+		return init(), nil
+	}
+
+	result := results[0]
+	for _, next := range results[1:] {
+		result = merge(result, next)
+	}
+	return result, nil
+}
+
+// collectInit, collectReduce, collectMerge - the default reduction
+// of the query, which collects the values in their order.
+func collectInit() interface{} {
+	return []interface{}{}
+}
+
+func collectReduce(result interface{}, value interface{}) interface{} {
+	return append(result.([]interface{}), value)
+}
+
+func collectMerge(result interface{}, next interface{}) interface{} {
+	return append(result.([]interface{}), next.([]interface{})...)
+}
+
+// sumQuery - the query of the sum of the amounts of all payments.
+func sumQuery(workers int) Query {
+	return Query{
+		Workers: workers,
+		Init: func() interface{} {
+			return new(types.Money)
+		},
+		Reduce: func(result interface{}, value interface{}) interface{} {
+			*result.(*types.Money) += value.(*types.Payment).Amount
+			return result
+		},
+		Merge: func(result interface{}, next interface{}) interface{} {
+			*result.(*types.Money) += *next.(*types.Money)
+			return result
+		},
+	}
+}
+
+// paymentsQuery - the query of the copies of the payments
+// selected by the filter, in their order.
+func paymentsQuery(workers int, filter func(payment types.Payment) bool) Query {
+	return Query{
+		Workers: workers,
+		Filter:  filter,
+		Init: func() interface{} {
+			return &[]types.Payment{}
+		},
+		Reduce: func(result interface{}, value interface{}) interface{} {
+			payments := result.(*[]types.Payment)
+			*payments = append(*payments, *value.(*types.Payment))
+			return result
+		},
+		Merge: func(result interface{}, next interface{}) interface{} {
+			payments := result.(*[]types.Payment)
+			*payments = append(*payments, *next.(*[]types.Payment)...)
+			return result
+		},
+	}
+}
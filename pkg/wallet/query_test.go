@@ -0,0 +1,121 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+func TestService_FilterPayments_order(t *testing.T) {
+	s := benchmarkStorageService(10_000)
+
+	want := []types.Payment{}
+	for _, payment := range s.store().PaymentsByAccount(7) {
+		want = append(want, *payment)
+	}
+
+	for _, workers := range []int{1, 3, 7, 64} {
+		payments, err := s.FilterPayments(7, workers)
+		if err != nil || !reflect.DeepEqual(payments, want) {
+			t.Errorf("FilterPayments(%d): wrong payments, error = %v", workers, err)
+		}
+
+		payments, err = s.FilterPaymentsByFn(func(payment types.Payment) bool {
+			return payment.AccountID == 7
+		}, workers)
+		if err != nil || !reflect.DeepEqual(payments, want) {
+			t.Errorf("FilterPaymentsByFn(%d): wrong payments, error = %v", workers, err)
+		}
+	}
+}
+
+func TestService_QueryPayments(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	ids := []interface{}{}
+	byCategory := map[types.PaymentCategory]types.Money{}
+	for _, payment := range s.store().Payments() {
+		if payment.AccountID == 1 {
+			ids = append(ids, payment.ID)
+		}
+		byCategory[payment.Category] += payment.Amount
+	}
+
+	for _, workers := range []int{0, 2, 5, 1000} {
+		// the values are collected in the order of the payments.
+		result, err := s.QueryPayments(context.Background(), Query{
+			Workers: workers,
+			Filter:  func(payment types.Payment) bool { return payment.AccountID == 1 },
+			Map:     func(payment types.Payment) interface{} { return payment.ID },
+		})
+		if err != nil || !reflect.DeepEqual(result, ids) {
+			t.Errorf("QueryPayments(%d): wrong IDs = %v, error = %v", workers, result, err)
+		}
+
+		result, err = s.QueryPayments(context.Background(), Query{
+			Workers: workers,
+			Init: func() interface{} {
+				return map[types.PaymentCategory]types.Money{}
+			},
+			Reduce: func(result interface{}, value interface{}) interface{} {
+				payment := value.(*types.Payment)
+				result.(map[types.PaymentCategory]types.Money)[payment.Category] += payment.Amount
+				return result
+			},
+			Merge: func(result interface{}, next interface{}) interface{} {
+				for category, amount := range next.(map[types.PaymentCategory]types.Money) {
+					result.(map[types.PaymentCategory]types.Money)[category] += amount
+				}
+				return result
+			},
+		})
+		if err != nil || !reflect.DeepEqual(result, byCategory) {
+			t.Errorf("QueryPayments(%d): wrong sums by category = %v, error = %v", workers, result, err)
+		}
+	}
+}
+
+func TestService_QueryPayments_empty(t *testing.T) {
+	s := newTestService()
+
+	result, err := s.QueryPayments(context.Background(), sumQuery(4))
+	if err != nil || *result.(*types.Money) != 0 {
+		t.Errorf("QueryPayments(): wrong sum of no payments = %v, error = %v", result, err)
+	}
+
+	result, err = s.QueryPayments(context.Background(), Query{Workers: 4})
+	if err != nil || !reflect.DeepEqual(result, []interface{}{}) {
+		t.Errorf("QueryPayments(): wrong values of no payments = %v, error = %v", result, err)
+	}
+
+	// the values of the same type are merged by Reduce.
+	Transactions(s)
+	result, err = s.QueryPayments(context.Background(), Query{
+		Workers: 3,
+		Map:     func(payment types.Payment) interface{} { return payment.Amount },
+		Init:    func() interface{} { return types.Money(0) },
+		Reduce: func(result interface{}, value interface{}) interface{} {
+			return result.(types.Money) + value.(types.Money)
+		},
+	})
+	if err != nil || result != s.SumPayments(1) {
+		t.Errorf("QueryPayments(): wrong sum = %v, error = %v", result, err)
+	}
+}
+
+func TestService_QueryPayments_canceled(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.QueryPayments(ctx, Query{Workers: 2})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("QueryPayments(): must return context.Canceled, returned = %v", err)
+	}
+}
@@ -1,7 +1,11 @@
 package wallet
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -9,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/SardorMS/wallet/pkg/types"
 	"github.com/google/uuid"
@@ -16,20 +21,141 @@ import (
 
 // Error variables.
 var (
-	ErrPhoneRegistered      = errors.New("phnone number already registered")
-	ErrAmountMustBePositive = errors.New("amount must be greater than zero")
-	ErrAccountNotFound      = errors.New("account not found")
-	ErrNotEnoughBalance     = errors.New("not enough balance")
-	ErrPaymentNotFound      = errors.New("payment not found")
-	ErrFavoriteNotFound     = errors.New("favorite not found")
+	ErrPhoneRegistered        = errors.New("phnone number already registered")
+	ErrAmountMustBePositive   = errors.New("amount must be greater than zero")
+	ErrAccountNotFound        = errors.New("account not found")
+	ErrNotEnoughBalance       = errors.New("not enough balance")
+	ErrPaymentNotFound        = errors.New("payment not found")
+	ErrFavoriteNotFound       = errors.New("favorite not found")
+	ErrTransferNotFound       = errors.New("transfer not found")
+	ErrSameAccount            = errors.New("can't transfer to the same account")
+	ErrInvalidTransition      = errors.New("invalid status transition")
+	ErrNotRepeatable          = errors.New("payment can't be repeated in its status")
+	ErrInvalidStatus          = errors.New("invalid payment status")
+	ErrUnbalancedPosting      = errors.New("debits and credits of the posting are not equal")
+	ErrBalanceMismatch        = errors.New("account balance doesn't match the journal")
+	ErrIdempotencyKeyReused   = errors.New("idempotency key is already used by another operation")
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+	ErrTxDone                 = errors.New("transaction is already committed or rolled back")
+	ErrBadLogRecord           = errors.New("bad write-ahead log record")
+	ErrMalformedRecord        = errors.New("malformed record")
+	ErrChecksumMismatch       = errors.New("dump file is corrupted")
+	ErrUnsupportedVersion     = errors.New("unsupported dump version")
+	ErrEncryptionKeyMissing   = errors.New("dump file is encrypted, but the key is not set")
+	ErrDecryptionFailed       = errors.New("can't decrypt the dump file")
+	ErrShardMissing           = errors.New("history shard listed in the manifest is missing")
+	ErrShardUnexpected        = errors.New("history shard is not listed in the manifest")
+	ErrInvalidRotation        = errors.New("invalid rotation of the history files")
+	ErrIncrementalUnsupported = errors.New("storage doesn't track the changes of the records")
+	ErrUnknownCheckpoint      = errors.New("checkpoint is unknown to the storage")
+	ErrIncrementOutOfOrder    = errors.New("increment doesn't follow the last imported one")
+	ErrImportConflict         = errors.New("imported record conflicts with the one in memory")
+	ErrSnapshotNotFound       = errors.New("dump snapshot not found")
+	ErrStorageFailed          = errors.New("storage failed and must be reopened")
 )
 
+// TransitionError - represents an attempt to change the status
+// of a payment(or transfer) in a way that is not allowed.
+type TransitionError struct {
+	ID   string
+	From types.PaymentStatus
+	To   types.PaymentStatus
+}
+
+// Error - implements error interface.
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%v: %s -> %s (id %s)", ErrInvalidTransition, e.From, e.To, e.ID)
+}
+
+// Unwrap - allows errors.Is(err, ErrInvalidTransition).
+func (e *TransitionError) Unwrap() error {
+	return ErrInvalidTransition
+}
+
+// RepeatError - represents an attempt to repeat the payment
+// whose status doesn't allow it.
+type RepeatError struct {
+	ID     string
+	Status types.PaymentStatus
+}
+
+// Error - implements error interface.
+func (e *RepeatError) Error() string {
+	return fmt.Sprintf("%v: %s (id %s)", ErrNotRepeatable, e.Status, e.ID)
+}
+
+// Unwrap - allows errors.Is(err, ErrNotRepeatable).
+func (e *RepeatError) Unwrap() error {
+	return ErrNotRepeatable
+}
+
+// accountCopy - returns the copy of the account found in the storage,
+// so the callers never share the records with the service.
+func accountCopy(account *types.Account, err error) (*types.Account, error) {
+	if err != nil {
+		return nil, err
+	}
+	copied := *account
+	return &copied, nil
+}
+
+// paymentCopy - returns the copy of the payment found in the storage.
+func paymentCopy(payment *types.Payment, err error) (*types.Payment, error) {
+	if err != nil {
+		return nil, err
+	}
+	copied := *payment
+	return &copied, nil
+}
+
+// transferCopy - returns the copy of the transfer found in the storage.
+func transferCopy(transfer *types.Transfer, err error) (*types.Transfer, error) {
+	if err != nil {
+		return nil, err
+	}
+	copied := *transfer
+	return &copied, nil
+}
+
+// favoriteCopy - returns the copy of the favorite found in the storage.
+func favoriteCopy(favorite *types.Favorite, err error) (*types.Favorite, error) {
+	if err != nil {
+		return nil, err
+	}
+	copied := *favorite
+	return &copied, nil
+}
+
+// checkTransition - returns TransitionError if the status can't be changed.
+func checkTransition(id string, from, to types.PaymentStatus) error {
+	if !from.CanTransitionTo(to) {
+		return &TransitionError{ID: id, From: from, To: to}
+	}
+	return nil
+}
+
 // Service - service struct.
+//
+// All methods of the Service are safe for concurrent use: reads are
+// performed in parallel, changes are serialized. The returned records
+// are copies, the callers are free to read and change them.
+//
+// The zero value keeps the data in a MemoryStorage,
+// NewService allows to keep it anywhere else.
 type Service struct {
+	mu            sync.RWMutex
+	clock         func() time.Time
+	keyWindow     time.Duration
+	importMode    ImportMode
+	mergePolicy   MergePolicy
+	codec         dumpCodec
 	nextAccountID int64
-	accounts      []*types.Account
-	payments      []*types.Payment
-	favorites     []*types.Favorite
+	storage       Storage
+	storageOnce   sync.Once
+
+	// lastIncrement - the checkpoint of the last increment imported,
+	// if the storage doesn't keep it.
+	lastIncrement string
 }
 
 // Progress - represent information about the progress
@@ -38,171 +164,496 @@ type Progress struct {
 	Result types.Money
 }
 
+// NewService - creates the service which keeps the data in the storage.
+func NewService(storage Storage) *Service {
+	s := &Service{storage: storage}
+	for _, account := range storage.Accounts() {
+		if account.ID > s.nextAccountID {
+			s.nextAccountID = account.ID
+		}
+	}
+	return s
+}
+
+// store - returns the storage of the service, creating
+// a MemoryStorage for the zero value.
+func (s *Service) store() Storage {
+	s.storageOnce.Do(func() {
+		if s.storage == nil {
+			s.storage = NewMemoryStorage()
+		}
+	})
+	return s.storage
+}
+
+// update - calls fn with a new transaction and commits it if fn succeeds.
+func (s *Service) update(fn func(tx Tx) error) error {
+	tx := s.store().Begin()
+	err := fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetClock - replaces the source of the current time(time.Now by default),
+// which is used to put timestamps on payments, deposits and favorites.
+func (s *Service) SetClock(clock func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clock = clock
+}
+
+// now - returns the current time of the service clock in UTC.
+func (s *Service) now() time.Time {
+	if s.clock == nil {
+		return time.Now().UTC()
+	}
+	return s.clock().UTC()
+}
+
 // RegisterAccount - authentication processes method performing.
 func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
-	for _, account := range s.accounts {
-		if account.Phone == phone {
-			return nil, ErrPhoneRegistered
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.store().AccountByPhone(phone); err == nil {
+		return nil, ErrPhoneRegistered
 	}
 
-	s.nextAccountID++
-	account := &types.Account{
-		ID:      s.nextAccountID,
+	account := types.Account{
+		ID:      s.nextAccountID + 1,
 		Phone:   phone,
 		Balance: 0,
 	}
-	s.accounts = append(s.accounts, account)
+	err := s.update(func(tx Tx) error {
+		tx.SaveAccount(account)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return account, nil
+	s.nextAccountID++
+	return accountCopy(s.store().Account(account.ID))
 }
 
 // FindAccountByID - method that find account by ID.
 func (s *Service) FindAccountByID(accountID int64) (*types.Account, error) {
-	for _, account := range s.accounts {
-		if account.ID == accountID {
-			return account, nil
-		}
-	}
-	return nil, ErrAccountNotFound
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return accountCopy(s.store().Account(accountID))
 }
 
 // Deposit -  replenish the user's account.
 func (s *Service) Deposit(accountID int64, amount types.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(func(tx Tx) error {
+		_, err := s.deposit(tx, accountID, amount)
+		return err
+	})
+}
+
+// deposit - Deposit within the transaction.
+func (s *Service) deposit(tx Tx, accountID int64, amount types.Money) (types.Deposit, error) {
 	if amount <= 0 {
-		return ErrAmountMustBePositive
+		return types.Deposit{}, ErrAmountMustBePositive
 	}
 
-	var account *types.Account
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-			break
-		}
+	account, err := s.store().Account(accountID)
+	if err != nil {
+		return types.Deposit{}, err
 	}
 
-	if account == nil {
-		return ErrAccountNotFound
+	deposit := types.Deposit{
+		ID:        uuid.New().String(),
+		AccountID: account.ID,
+		Amount:    amount,
+		Created:   s.now(),
 	}
 
-	account.Balance += amount
-	return nil
+	err = s.post(tx, types.EntryDeposit, deposit.ID, deposit.Created,
+		debit(types.LedgerExternalFunding, amount),
+		credit(types.CustomerLedger(account.ID), amount))
+	if err != nil {
+		return types.Deposit{}, err
+	}
+
+	tx.SaveDeposit(deposit)
+	return deposit, nil
+}
+
+// ExportAccountDeposits - pulls out deposits of a specific account.
+func (s *Service) ExportAccountDeposits(accountID int64) ([]types.Deposit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err := s.store().Account(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	deposits := []types.Deposit{}
+	for _, deposit := range s.store().DepositsByAccount(accountID) {
+		deposits = append(deposits, *deposit)
+	}
+	return deposits, nil
 }
 
 // Pay - payments method.
 func (s *Service) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
-	if amount <= 0 {
-		return nil, ErrAmountMustBePositive
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.commitPayment(func(tx Tx) (types.Payment, error) {
+		return s.pay(tx, accountID, amount, category)
+	})
+}
+
+// commitPayment - makes the payment within a new transaction
+// and returns the saved one.
+func (s *Service) commitPayment(pay func(tx Tx) (types.Payment, error)) (*types.Payment, error) {
+	var payment types.Payment
+	err := s.update(func(tx Tx) (err error) {
+		payment, err = pay(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return paymentCopy(s.store().Payment(payment.ID))
+}
 
-	var account *types.Account
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-			break
-		}
+// pay - Pay within the transaction.
+func (s *Service) pay(tx Tx, accountID int64, amount types.Money, category types.PaymentCategory) (types.Payment, error) {
+	if amount <= 0 {
+		return types.Payment{}, ErrAmountMustBePositive
 	}
-	if account == nil {
-		return nil, ErrAccountNotFound
+
+	account, err := s.store().Account(accountID)
+	if err != nil {
+		return types.Payment{}, err
 	}
 
 	if account.Balance < amount {
-		return nil, ErrNotEnoughBalance
+		return types.Payment{}, ErrNotEnoughBalance
 	}
 
-	account.Balance -= amount
 	paymentID := uuid.New().String()
-	payment := &types.Payment{
+	now := s.now()
+	payment := types.Payment{
 		ID:        paymentID,
 		AccountID: accountID,
 		Amount:    amount,
 		Category:  category,
 		Status:    types.PaymentStatusInProgress,
+		Created:   now,
+		Updated:   now,
 	}
-	s.payments = append(s.payments, payment)
+
+	err = s.post(tx, types.EntryPayment, payment.ID, now,
+		debit(types.CustomerLedger(account.ID), amount),
+		credit(types.LedgerMerchantClearing, amount))
+	if err != nil {
+		return types.Payment{}, err
+	}
+
+	tx.SavePayment(payment)
 	return payment, nil
 }
 
 // FindPaymentByID - method that find payment by ID.
 func (s *Service) FindPaymentByID(paymentID string) (*types.Payment, error) {
-	for _, payment := range s.payments {
-		if payment.ID == paymentID {
-			return payment, nil
-		}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return paymentCopy(s.store().Payment(paymentID))
+}
+
+// Confirm - marks the payment as successfully completed.
+func (s *Service) Confirm(paymentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payment, err := s.store().Payment(paymentID)
+	if err != nil {
+		return err
+	}
+
+	err = checkTransition(payment.ID, payment.Status, types.PaymentStatusOK)
+	if err != nil {
+		return err
 	}
-	return nil, ErrPaymentNotFound
+
+	confirmed := *payment
+	confirmed.Status = types.PaymentStatusOK
+	confirmed.Updated = s.now()
+	return s.update(func(tx Tx) error {
+		tx.SavePayment(confirmed)
+		return nil
+	})
 }
 
 // Reject - method that returns payment in a accident of error.
 func (s *Service) Reject(paymentID string) error {
-	payment, err := s.FindPaymentByID(paymentID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payment, err := s.store().Payment(paymentID)
 	if err != nil {
 		return err
 	}
-	account, err := s.FindAccountByID(payment.AccountID)
+	account, err := s.store().Account(payment.AccountID)
 	if err != nil {
 		return err
 	}
 
-	payment.Status = types.PaymentStatusFail
-	account.Balance += payment.Amount
-	return nil
+	err = checkTransition(payment.ID, payment.Status, types.PaymentStatusFail)
+	if err != nil {
+		return err
+	}
+
+	rejected := *payment
+	rejected.Status = types.PaymentStatusFail
+	rejected.Updated = s.now()
+	return s.update(func(tx Tx) error {
+		err := s.post(tx, types.EntryRefund, payment.ID, rejected.Updated,
+			debit(types.LedgerMerchantClearing, payment.Amount),
+			credit(types.CustomerLedger(account.ID), payment.Amount))
+		if err != nil {
+			return err
+		}
+
+		tx.SavePayment(rejected)
+		return nil
+	})
 }
 
-// Repeat - repeats payment.
+// Repeat - repeats payment. Only the confirmed or rejected payments
+// are repeated, the one in progress returns RepeatError.
 func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
-	payment, err := s.FindPaymentByID(paymentID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payment, err := s.store().Payment(paymentID)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.Pay(payment.AccountID, payment.Amount, payment.Category)
+	if !payment.Status.IsValid() {
+		return nil, ErrInvalidStatus
+	}
+
+	if !payment.Status.CanRepeat() {
+		return nil, &RepeatError{ID: payment.ID, Status: payment.Status}
+	}
+
+	return s.commitPayment(func(tx Tx) (types.Payment, error) {
+		return s.pay(tx, payment.AccountID, payment.Amount, payment.Category)
+	})
+}
+
+// Transfer - moves money from one account to another.
+func (s *Service) Transfer(fromID, toID int64, amount types.Money) (*types.Transfer, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+
+	if fromID == toID {
+		return nil, ErrSameAccount
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from, err := s.store().Account(fromID)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := s.store().Account(toID)
+	if err != nil {
+		return nil, err
+	}
+
+	if from.Balance < amount {
+		return nil, ErrNotEnoughBalance
+	}
+
+	now := s.now()
+	transfer := types.Transfer{
+		ID:            uuid.New().String(),
+		FromAccountID: fromID,
+		ToAccountID:   toID,
+		Amount:        amount,
+		Status:        types.PaymentStatusInProgress,
+		Created:       now,
+		Updated:       now,
+	}
+
+	// the debit and the credit are posted together or not at all.
+	err = s.update(func(tx Tx) error {
+		err := s.post(tx, types.EntryTransfer, transfer.ID, now,
+			debit(types.CustomerLedger(from.ID), amount),
+			credit(types.CustomerLedger(to.ID), amount))
+		if err != nil {
+			return err
+		}
+
+		tx.SaveTransfer(transfer)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transferCopy(s.store().Transfer(transfer.ID))
+}
+
+// FindTransferByID - method that find transfer by ID.
+func (s *Service) FindTransferByID(transferID string) (*types.Transfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return transferCopy(s.store().Transfer(transferID))
+}
+
+// ConfirmTransfer - marks the transfer as successfully completed.
+func (s *Service) ConfirmTransfer(transferID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transfer, err := s.store().Transfer(transferID)
+	if err != nil {
+		return err
+	}
+
+	err = checkTransition(transfer.ID, transfer.Status, types.PaymentStatusOK)
+	if err != nil {
+		return err
+	}
+
+	confirmed := *transfer
+	confirmed.Status = types.PaymentStatusOK
+	confirmed.Updated = s.now()
+	return s.update(func(tx Tx) error {
+		tx.SaveTransfer(confirmed)
+		return nil
+	})
+}
+
+// RejectTransfer - reverses the transfer, returning money to the sender.
+func (s *Service) RejectTransfer(transferID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transfer, err := s.store().Transfer(transferID)
+	if err != nil {
+		return err
+	}
+
+	err = checkTransition(transfer.ID, transfer.Status, types.PaymentStatusFail)
+	if err != nil {
+		return err
+	}
+
+	from, err := s.store().Account(transfer.FromAccountID)
+	if err != nil {
+		return err
+	}
+
+	to, err := s.store().Account(transfer.ToAccountID)
+	if err != nil {
+		return err
+	}
+
+	if to.Balance < transfer.Amount {
+		return ErrNotEnoughBalance
+	}
+
+	rejected := *transfer
+	rejected.Status = types.PaymentStatusFail
+	rejected.Updated = s.now()
+	return s.update(func(tx Tx) error {
+		err := s.post(tx, types.EntryReversal, transfer.ID, rejected.Updated,
+			debit(types.CustomerLedger(to.ID), transfer.Amount),
+			credit(types.CustomerLedger(from.ID), transfer.Amount))
+		if err != nil {
+			return err
+		}
+
+		tx.SaveTransfer(rejected)
+		return nil
+	})
 }
 
 // FavoritePayment - makes a favorite from a specific payment.
 func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorite, error) {
-	payment, err := s.FindPaymentByID(paymentID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payment, err := s.store().Payment(paymentID)
 	if err != nil {
 		return nil, err
 	}
 
 	favoriteID := uuid.New().String()
-	favorite := &types.Favorite{
+	favorite := types.Favorite{
 		ID:        favoriteID,
 		AccountID: payment.AccountID,
 		Amount:    payment.Amount,
 		Name:      name,
 		Category:  payment.Category,
+		Created:   s.now(),
 	}
 
-	s.favorites = append(s.favorites, favorite)
-	return favorite, nil
+	err = s.update(func(tx Tx) error {
+		tx.SaveFavorite(favorite)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return favoriteCopy(s.store().Favorite(favorite.ID))
 }
 
 // FindFavoriteByID - method that find favorite payment by ID.
 func (s *Service) FindFavoriteByID(favoriteID string) (*types.Favorite, error) {
-	for _, favorite := range s.favorites {
-		if favorite.ID == favoriteID {
-			return favorite, nil
-		}
-	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	return nil, ErrFavoriteNotFound
+	return favoriteCopy(s.store().Favorite(favoriteID))
 }
 
 // PayFromFavorites - makes a payment from a specific favorite one.
 func (s *Service) PayFromFavorite(favoriteID string) (*types.Payment, error) {
-	favorite, err := s.FindFavoriteByID(favoriteID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.commitPayment(func(tx Tx) (types.Payment, error) {
+		return s.payFromFavorite(tx, favoriteID)
+	})
+}
+
+// payFromFavorite - PayFromFavorite within the transaction.
+func (s *Service) payFromFavorite(tx Tx, favoriteID string) (types.Payment, error) {
+	favorite, err := s.store().Favorite(favoriteID)
 	if err != nil {
-		return nil, err
+		return types.Payment{}, err
 	}
 
-	return s.Pay(favorite.AccountID, favorite.Amount, favorite.Category)
+	return s.pay(tx, favorite.AccountID, favorite.Amount, favorite.Category)
 }
 
 // ExportToFile - writes accounts to a file.
 func (s *Service) ExportToFile(path string) error {
-	file, err := os.Create(path)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, filePerm)
 	if err != nil {
 		log.Print(err)
 		return err
@@ -214,12 +665,26 @@ func (s *Service) ExportToFile(path string) error {
 		}
 	}()
 
+	err = s.ExportToWriter(file)
+	if err != nil {
+		return err
+	}
+	log.Printf("%#v", file)
+	return nil
+}
+
+// ExportToWriter - writes accounts to the writer
+// in the format of ExportToFile.
+func (s *Service) ExportToWriter(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	data := make([]byte, 0)
 	lastStr := ""
-	for _, account := range s.accounts {
+	for _, account := range s.store().Accounts() {
 		text := []byte(
 			strconv.FormatInt(int64(account.ID), 10) + string(";") +
-				string(account.Phone) + string(";") +
+				escapeField(string(account.Phone)) + string(";") +
 				strconv.FormatInt(int64(account.Balance), 10) + string("|"))
 
 		data = append(data, text...)
@@ -227,12 +692,11 @@ func (s *Service) ExportToFile(path string) error {
 		lastStr = strings.TrimSuffix(str, "|")
 	}
 
-	_, err = file.Write([]byte(lastStr))
+	_, err := w.Write([]byte(lastStr))
 	if err != nil {
 		log.Print(err)
 		return err
 	}
-	log.Printf("%#v", file)
 	return nil
 }
 
@@ -250,10 +714,25 @@ func (s *Service) ImportFromFile(path string) error {
 		}
 	}()
 
+	return s.importAccounts(file, filepath.Base(path))
+}
+
+// ImportFromReader - import(reads) accounts written by ExportToWriter,
+// the errors have no file name.
+func (s *Service) ImportFromReader(r io.Reader) error {
+	return s.importAccounts(r, "")
+}
+
+// importAccounts - reads accounts from the reader,
+// the name of the file is used in the errors.
+func (s *Service) importAccounts(r io.Reader, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	content := make([]byte, 0)
 	buf := make([]byte, 4)
 	for {
-		read, err := file.Read(buf)
+		read, err := r.Read(buf)
 		if err == io.EOF {
 			content = append(content, buf[:read]...)
 			break
@@ -269,108 +748,106 @@ func (s *Service) ImportFromFile(path string) error {
 	data := string(content)
 	log.Println("data: ", data)
 
-	acc := strings.Split(data, "|")
+	acc := splitEscaped(data, '|')
 	log.Println("acc: ", acc)
 
-	for _, operation := range acc {
+	// the records are numbered as lines in the errors.
+	snap := newSnapshot()
+	var errs ImportErrors
+	for i, operation := range acc {
+		if strings.TrimSpace(operation) == "" {
+			continue
+		}
 
-		strAcc := strings.Split(operation, ";")
+		strAcc := splitRecord(strings.TrimSpace(operation), ';')
 		log.Println("strAcc:", strAcc)
 
-		id, _ := strconv.ParseInt(strAcc[0], 10, 64)
-
-		phone := types.Phone(strAcc[1])
-
-		balance, _ := strconv.ParseInt(strAcc[2], 10, 64)
-
-		account := &types.Account{
-			ID:      id,
-			Phone:   phone,
-			Balance: types.Money(balance),
+		if err := snap.decode(kindAccount, strAcc); err != nil {
+			err.File = name
+			err.Line = i + 1
+			log.Print(err)
+			errs = append(errs, err)
+			continue
 		}
+		snap.lines[kindAccount] = append(snap.lines[kindAccount], i+1)
+	}
 
-		s.accounts = append(s.accounts, account)
-		log.Print(account)
+	// the file has no journal, so the balances are taken as opening ones.
+	err := s.importSnapshot(snap, errs)
+	var rejected ImportErrors
+	if errors.As(err, &rejected) {
+		for _, ferr := range rejected {
+			ferr.File = name
+		}
 	}
-	return nil
+	return err
 }
 
-//Export - writes accounts, payments, favorites to a dump file(full_version).
+// Export - writes accounts, payments, favorites to a dump file(full_version).
+//
+// The files are written to a new generation directory, which becomes
+// the current one only when all of them are written, so Import always
+// reads a complete snapshot. The files are compressed and encrypted
+// as set by SetCompression and SetEncryptionKey, Import detects it
+// by the files themselves.
 func (s *Service) Export(dir string) error {
 
-	path, _ := filepath.Abs(dir)
-	os.MkdirAll(dir, 0666)
-
-	//-----accounts (export)
-	if s.accounts != nil && len(s.accounts) > 0 {
-
-		data := make([]byte, 0)
-		for _, account := range s.accounts {
-			text := []byte(
-				strconv.FormatInt(int64(account.ID), 10) + ";" +
-					string(account.Phone) + ";" +
-					strconv.FormatInt(int64(account.Balance), 10) + "\n")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-			data = append(data, text...)
-		}
-
-		err := os.WriteFile(path+"/accounts.dump", data, 0666)
-		if err != nil {
-			log.Print(err)
-			return err
-		}
+	err := os.MkdirAll(dir, dirPerm)
+	if err != nil {
+		log.Print(err)
+		return err
 	}
 
-	//-----payments (export)
-	if s.payments != nil && len(s.payments) > 0 {
-
-		data := make([]byte, 0)
-		for _, payment := range s.payments {
-			text := []byte(
-				string(payment.ID) + ";" +
-					strconv.FormatInt(int64(payment.AccountID), 10) + ";" +
-					strconv.FormatInt(int64(payment.Amount), 10) + ";" +
-					string(payment.Category) + ";" +
-					string(payment.Status) + "\n")
+	err = writeGeneration(dir, s.exportSnapshot(), s.codec)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	return nil
+}
 
-			data = append(data, text...)
-		}
+// ExportDump - writes the dump files of Export to the writer
+// as the tar archive.
+func (s *Service) ExportDump(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-		err := os.WriteFile(path+"/payments.dump", data, 0666)
-		if err != nil {
-			log.Print(err)
-			return err
-		}
+	err := writeArchive(w, s.exportSnapshot(), s.codec)
+	if err != nil {
+		log.Print(err)
+		return err
 	}
+	return nil
+}
 
-	// -----favorites (export)
-	if s.favorites != nil && len(s.favorites) > 0 {
-
-		data := make([]byte, 0)
-		for _, favorite := range s.favorites {
-			text := []byte(
-				string(favorite.ID) + ";" +
-					strconv.FormatInt(int64(favorite.AccountID), 10) + ";" +
-					string(favorite.Name) + ";" +
-					strconv.FormatInt(int64(favorite.Amount), 10) + ";" +
-					string(favorite.Category) + "\n")
+// exportSnapshot - copies the records to export.
+func (s *Service) exportSnapshot() *snapshot {
+	snap := takeSnapshot(s.store())
+	snap.keys = s.liveKeys(snap.keys)
+	return snap
+}
 
-			data = append(data, text...)
-		}
-
-		err := os.WriteFile(path+"/favorites.dump", data, 0666)
-		if err != nil {
-			log.Print(err)
-			return err
+// liveKeys - returns the idempotency keys which are not expired,
+// the expired ones are not worth keeping.
+func (s *Service) liveKeys(records []types.IdempotencyKey) []types.IdempotencyKey {
+	keys := records[:0:0]
+	for _, record := range records {
+		if !s.keyExpired(&record) {
+			keys = append(keys, record)
 		}
 	}
-
-	return nil
+	return keys
 }
 
 // Import - import(reads) from dump file to accounts, payments and favorites(full_version).
 func (s *Service) Import(dir string) error {
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	var path string
 	if filepath.IsAbs(path) {
 		// path, _ = filepath.Abs(dir)
@@ -379,155 +856,155 @@ func (s *Service) Import(dir string) error {
 		path = dir
 	}
 
-	// -----accounts (import)
-	accFile, err1 := os.ReadFile(path + "/accounts.dump")
-	if err1 == nil {
-
-		accData := string(accFile)
-		accData = strings.TrimSpace(accData)
-
-		accSlice := strings.Split(accData, "\n")
-		log.Print("accounts : ", accSlice)
+	snap, errs, err := readDump(path, s.codec)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	return s.importSnapshot(snap, errs)
+}
 
-		for _, accOperation := range accSlice {
+// ImportDump - import(reads) the tar archive written by ExportDump.
+func (s *Service) ImportDump(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			if len(accOperation) == 0 {
-				break
-			}
-			accStr := strings.Split(accOperation, ";")
-			log.Println("accStr:", accStr)
-
-			id, _ := strconv.ParseInt(accStr[0], 10, 64)
-			phone := types.Phone(accStr[1])
-			balance, _ := strconv.ParseInt(accStr[2], 10, 64)
-
-			accFind, _ := s.FindAccountByID(id)
-			if accFind != nil {
-				accFind.Phone = phone
-				accFind.Balance = types.Money(balance)
-			} else {
-				s.nextAccountID++
-				account := &types.Account{
-					ID:      id,
-					Phone:   phone,
-					Balance: types.Money(balance),
-				}
-				s.accounts = append(s.accounts, account)
-				log.Print(account)
-			}
-		}
-	} else {
-		log.Print(err1)
+	snap, errs, err := readArchive(r, s.codec)
+	if err != nil {
+		log.Print(err)
+		return err
 	}
+	return s.importSnapshot(snap, errs)
+}
 
-	// -----payments (import)
-	payFile, err2 := os.ReadFile(path + "/payments.dump")
-	if err2 == nil {
-
-		payData := string(payFile)
-		payData = strings.TrimSpace(payData)
+// importSnapshot - merges the records read from the dump files into
+// the storage as set by the merge policy. The records rejected here are
+// added to the errors of reading; in the strict mode(or on a conflict
+// under MergeFailOnConflict) nothing is imported if there are any.
+func (s *Service) importSnapshot(snap *snapshot, errs ImportErrors) error {
+	plan := s.planImport(snap, errs)
+	errs = plan.errs
+	if errs != nil && (s.importMode == ImportStrict || s.mergePolicy == MergeFailOnConflict && plan.diff.Conflicting != nil) {
+		return errs
+	}
 
-		paySlice := strings.Split(payData, "\n")
-		log.Print("paySlice : ", paySlice)
+	save := plan.save
+	err := s.update(func(tx Tx) error {
+		if save.increment != nil {
+			deleteRecords(tx, save.increment.deleted)
+		}
+		// the history of the accounts the file replaces.
+		deleteRecords(tx, plan.remove)
 
-		for _, payOperation := range paySlice {
+		for _, account := range save.accounts {
+			tx.SaveAccount(account)
+		}
+		for _, payment := range save.payments {
+			tx.SavePayment(payment)
+		}
+		for _, favorite := range save.favorites {
+			tx.SaveFavorite(favorite)
+		}
+		for _, transfer := range save.transfers {
+			tx.SaveTransfer(transfer)
+		}
+		for _, deposit := range save.deposits {
+			tx.SaveDeposit(deposit)
+		}
+		for _, posting := range save.postings {
+			tx.SavePosting(posting)
+		}
+		for _, record := range save.keys {
+			tx.SaveIdempotencyKey(record)
+		}
 
-			if len(payOperation) == 0 {
-				break
-			}
-			payStr := strings.Split(payOperation, ";")
-			log.Println("payStr:", payStr)
-
-			id := payStr[0]
-			accountID, _ := strconv.ParseInt(payStr[1], 10, 64)
-			amount, _ := strconv.ParseInt(payStr[2], 10, 64)
-			category := types.PaymentCategory(payStr[3])
-			status := types.PaymentStatus(payStr[4])
-
-			payAcc, _ := s.FindPaymentByID(id)
-			if payAcc != nil {
-				payAcc.AccountID = accountID
-				payAcc.Amount = types.Money(amount)
-				payAcc.Category = category
-				payAcc.Status = status
-			} else {
-				payment := &types.Payment{
-					ID:        id,
-					AccountID: accountID,
-					Amount:    types.Money(amount),
-					Category:  category,
-					Status:    status,
-				}
-				s.payments = append(s.payments, payment)
-				log.Print(payment)
-			}
+		if tx, ok := tx.(checkpointTx); ok && save.increment != nil {
+			tx.saveCheckpoint(save.increment.to)
 		}
-	} else {
-		log.Print(err2)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// -----favorites (import)
-	favFile, err3 := os.ReadFile(path + "/favorites.dump")
-	if err3 == nil {
+	// the imported accounts keep their IDs, the next registered one
+	// must not take any of them.
+	for _, account := range save.accounts {
+		if account.ID > s.nextAccountID {
+			s.nextAccountID = account.ID
+		}
+	}
+	if snap.nextAccountID > s.nextAccountID {
+		s.nextAccountID = snap.nextAccountID
+	}
 
-		favData := string(favFile)
-		favData = strings.TrimSpace(favData)
+	if !snap.found[kindPosting] {
+		// balances of the dump without a journal are taken as opening ones.
+		err = s.update(s.openBalances)
+	} else {
+		// the journal after the merge gives the balances.
+		err = s.update(s.journalBalances(save))
+	}
+	if err != nil {
+		return err
+	}
 
-		favSlice := strings.Split(favData, "\n")
-		log.Print("favSlice : ", favSlice)
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
 
-		for _, favOperation := range favSlice {
+// deleteRecords - removes the records with the IDs by the kinds.
+func deleteRecords(tx Tx, ids map[recordKind][]string) {
+	for _, id := range ids[kindAccount] {
+		accountID, _ := strconv.ParseInt(id, 10, 64)
+		tx.DeleteAccount(accountID)
+	}
+	for _, id := range ids[kindPayment] {
+		tx.DeletePayment(id)
+	}
+	for _, id := range ids[kindFavorite] {
+		tx.DeleteFavorite(id)
+	}
+	for _, id := range ids[kindTransfer] {
+		tx.DeleteTransfer(id)
+	}
+	for _, id := range ids[kindDeposit] {
+		tx.DeleteDeposit(id)
+	}
+	for _, id := range ids[kindPosting] {
+		tx.DeletePosting(id)
+	}
+}
 
-			if len(favOperation) == 0 {
-				break
-			}
-			favStr := strings.Split(favOperation, ";")
-			log.Println("favStr:", favStr)
-
-			id := favStr[0]
-			accountID, _ := strconv.ParseInt(favStr[1], 10, 64)
-			name := favStr[2]
-			amount, _ := strconv.ParseInt(favStr[3], 10, 64)
-			category := types.PaymentCategory(favStr[4])
-			favAcc, _ := s.FindFavoriteByID(id)
-
-			if favAcc != nil {
-				favAcc.AccountID = accountID
-				favAcc.Name = name
-				favAcc.Amount = types.Money(amount)
-				favAcc.Category = category
-			} else {
-				favorite := &types.Favorite{
-					ID:        id,
-					AccountID: accountID,
-					Name:      name,
-					Amount:    types.Money(amount),
-					Category:  category,
-				}
-				s.favorites = append(s.favorites, favorite)
-				log.Print(favorite)
-			}
-		}
-	} else {
-		log.Println(err3)
+// checkImportedTransition - validates the status of an imported record
+// against the status of the record already held in memory(if any).
+func checkImportedTransition(id string, current *types.PaymentStatus, status types.PaymentStatus) error {
+	if !status.IsValid() {
+		return fmt.Errorf("%w: %q (id %s)", ErrInvalidStatus, status, id)
 	}
 
-	return nil
+	if current == nil || *current == status {
+		return nil
+	}
+	return checkTransition(id, *current, status)
 }
 
 // ExportAccountHistory - pulls out payments of a specific account.
 func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error) {
 
-	_, err := s.FindAccountByID(accountID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err := s.store().Account(accountID)
 	if err != nil {
 		return nil, ErrAccountNotFound
 	}
 
 	payments := []types.Payment{}
-	for _, payment := range s.payments {
-		if payment.AccountID == accountID {
-			payments = append(payments, *payment)
-		}
+	for _, payment := range s.store().PaymentsByAccount(accountID) {
+		payments = append(payments, *payment)
 	}
 
 	if len(payments) <= 0 || payments == nil {
@@ -539,194 +1016,136 @@ func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error)
 
 // HistoryToFiles - save all data(information about the payments) to files.
 func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
-
-	_, cerr := os.Stat(dir)
-	if os.IsNotExist(cerr) {
-		cerr = os.Mkdir(dir, 0777)
-	}
-	if cerr != nil {
-		return cerr
+	if records <= 0 {
+		return fmt.Errorf("%w: %d records per file", ErrInvalidRotation, records)
 	}
+	return s.HistoryToFilesBy(payments, dir, Rotation{Records: records})
+}
 
-	if len(payments) == 0 || payments == nil {
-		return nil
+// HistoryToWriters - writes the payments the same way as HistoryToFiles,
+// the writer of every file is opened by create with the name of the file
+// and closed when the file is written.
+func (s *Service) HistoryToWriters(payments []types.Payment, records int, create func(name string) (io.WriteCloser, error)) error {
+	if records <= 0 {
+		return fmt.Errorf("%w: %d records per file", ErrInvalidRotation, records)
 	}
-	// log.Printf("payments = %v \n dir = %v \n records = %v", payments, dir, records)
-
-	data := make([]byte, 0)
-
-	if len(payments) > 0 && len(payments) <= records {
-		for _, payment := range payments {
-			text := []byte(
-				string(payment.ID) + ";" +
-					strconv.FormatInt(int64(payment.AccountID), 10) + ";" +
-					strconv.FormatInt(int64(payment.Amount), 10) + ";" +
-					string(payment.Category) + ";" +
-					string(payment.Status) + "\n")
-
-			data = append(data, text...)
-		}
-
-		path := dir + "/payments.dump"
-		err := os.WriteFile(path, data, 0777)
-		if err != nil {
-			log.Print(err)
-			return err
-		}
-	} else {
-		for i, payment := range payments {
-
-			text := []byte(
-				string(payment.ID) + ";" +
-					strconv.FormatInt(int64(payment.AccountID), 10) + ";" +
-					strconv.FormatInt(int64(payment.Amount), 10) + ";" +
-					string(payment.Category) + ";" +
-					string(payment.Status) + "\n")
-
-			data = append(data, text...)
-
-			if (i+1)%records == 0 || i == len(payments)-1 {
+	return s.HistoryToWritersBy(payments, Rotation{Records: records}, create)
+}
 
-				path := dir + "/payments" + strconv.Itoa((i/records)+1) + ".dump"
-				err := os.WriteFile(path, data, 0777)
-				if err != nil {
-					log.Print(err)
-					return err
-				}
-				data = nil
-			}
-		}
+// writeHistory - writes the dump file with the records to the writer
+// opened by create and returns its entry of the manifest.
+func writeHistory(create func(name string) (io.WriteCloser, error), codec dumpCodec, name string, records []string) (historyShard, error) {
+	data, err := codec.seal(encodeDump(records))
+	if err != nil {
+		return historyShard{}, err
 	}
-	return nil
-}
 
-// SumPayments - summarizes payments using goroutines.
-func (s *Service) SumPayments(goroutines int) types.Money {
+	w, err := create(name)
+	if err != nil {
+		return historyShard{}, err
+	}
 
-	if goroutines < 1 {
-		goroutines = 1
+	_, err = w.Write(data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
 	}
 
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
+	sum := sha256.Sum256(data)
+	return historyShard{name: name, records: len(records), sum: hex.EncodeToString(sum[:])}, err
+}
 
-	num := len(s.payments)/goroutines + 1
-	sum := types.Money(0)
+// cancelCheck - how often the workers of the aggregations check
+// the context for cancellation, in payments.
+const cancelCheck = 1024
 
-	for i := 0; i < goroutines; i++ {
+// SumPayments - summarizes payments using goroutines.
+func (s *Service) SumPayments(goroutines int) types.Money {
+	sum, _ := s.SumPaymentsContext(context.Background(), goroutines)
+	return sum
+}
 
-		wg.Add(1)
-		total := types.Money(0)
+// SumPaymentsContext - summarizes payments like SumPayments, the workers
+// stop when the context is done and ctx.Err() is returned.
+func (s *Service) SumPaymentsContext(ctx context.Context, goroutines int) (types.Money, error) {
 
-		go func(val int) {
-			defer wg.Done()
-			lowIndex := val * num
-			highIndex := (val * num) + num
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-			for j := lowIndex; j < highIndex; j++ {
-				if j > len(s.payments)-1 {
-					break
-				}
-				total += s.payments[j].Amount
-			}
-			mu.Lock()
-			defer mu.Unlock()
-			sum += total
-		}(i)
+	// the workers read the storage, so they are waited for under the lock.
+	sum, err := sumQuery(goroutines).run(ctx, s.store().Payments(), false)
+	if err != nil {
+		return 0, err
 	}
-
-	wg.Wait()
-	return sum
+	return *sum.(*types.Money), nil
 }
 
 // FilterPayments - filters out payments by accountID using goroutines.
 func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payment, error) {
+	return s.FilterPaymentsContext(context.Background(), accountID, goroutines)
+}
+
+// FilterPaymentsContext - filters out payments like FilterPayments, the workers
+// stop when the context is done and ctx.Err() is returned.
+func (s *Service) FilterPaymentsContext(ctx context.Context, accountID int64, goroutines int) ([]types.Payment, error) {
 
-	_, err := s.FindAccountByID(accountID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err := s.store().Account(accountID)
 	if err != nil {
 		return nil, err
 	}
 
-	if goroutines < 1 {
-		goroutines = 1
+	filter := func(payment types.Payment) bool {
+		return payment.AccountID == accountID
 	}
 
-	num := len(s.payments)/goroutines + 1
-
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-
-	payments := []types.Payment{}
-
-	for i := 0; i < goroutines; i++ {
-
-		wg.Add(1)
-		partOfPayment := []types.Payment{}
-
-		go func(val int) {
-			defer wg.Done()
-			lowIndex := val * num
-			highIndex := (val * num) + num
-
-			for j := lowIndex; j < highIndex; j++ {
-				if j > len(s.payments)-1 {
-					break
-				}
-				if s.payments[j].AccountID == accountID {
-					partOfPayment = append(partOfPayment, *s.payments[j])
-				}
-			}
-			mu.Lock()
-			defer mu.Unlock()
-			payments = append(payments, partOfPayment...)
-		}(i)
+	// the workers read the storage, so they are waited for under the lock.
+	payments, err := paymentsQuery(goroutines, filter).run(ctx, s.store().Payments(), false)
+	if err != nil {
+		return nil, err
 	}
-
-	wg.Wait()
-	return payments, nil
+	return *payments.(*[]types.Payment), nil
 }
 
 // FilterPaymentsByFn - filters out payments by any function.
 func (s *Service) FilterPaymentsByFn(
 	filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
+	return s.FilterPaymentsByFnContext(context.Background(), filter, goroutines)
+}
 
-	if goroutines < 1 {
-		goroutines = 1
-	}
-
-	num := len(s.payments)/goroutines + 1
-
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-
-	payments := []types.Payment{}
-
-	for i := 0; i < goroutines; i++ {
+// FilterPaymentsByFnContext - filters out payments like FilterPaymentsByFn.
+// When the context is done, ctx.Err() is returned at once and the workers
+// stop before the next call of the filter; the calls already made
+// are not interrupted.
+func (s *Service) FilterPaymentsByFnContext(ctx context.Context,
+	filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
 
-		wg.Add(1)
-		partOfPayment := []types.Payment{}
+	// the filter is called without holding the lock,
+	// so it is free to call the methods of the service itself.
+	payments, err := s.QueryPayments(ctx, paymentsQuery(goroutines, filter))
+	if err != nil {
+		return nil, err
+	}
+	return *payments.(*[]types.Payment), nil
+}
 
-		go func(val int) {
-			defer wg.Done()
-			lowIndex := val * num
-			highIndex := (val * num) + num
+// waitContext - waits for the goroutines of the group or for the context
+// to be done, whichever comes first, and returns ctx.Err() in the last case.
+// The goroutines left behind must stop by themselves.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wg.Wait()
+	}()
 
-			for j := lowIndex; j < highIndex; j++ {
-				if j > len(s.payments)-1 {
-					break
-				}
-				if filter(*s.payments[j]) {
-					partOfPayment = append(partOfPayment, *s.payments[j])
-				}
-			}
-			mu.Lock()
-			defer mu.Unlock()
-			payments = append(payments, partOfPayment...)
-		}(i)
+	select {
+	case <-done:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	wg.Wait()
-	return payments, nil
 }
 
 // FilterCategory - puts the needed category.
@@ -735,20 +1154,27 @@ func FilterCategory(payment types.Payment) bool {
 }
 
 // SumPaymentsWithProgress - summarizes payments by adding them to the channel.
+//
+// The channel has room for all parts, so the goroutines finish
+// even if the consumer stops reading.
 func (s *Service) SumPaymentsWithProgress() <-chan Progress {
+	return s.SumPaymentsWithProgressContext(context.Background())
+}
 
-	// if len(s.payments) == 0 {
-	// 	ch := make(chan Progress)
-	// 	close(ch)
-	// 	return ch
-	// }
+// SumPaymentsWithProgressContext - summarizes payments like
+// SumPaymentsWithProgress. When the context is done, the goroutines stop
+// and the channel is closed without the parts which aren't summed yet,
+// the consumer checks ctx.Err() to know it.
+func (s *Service) SumPaymentsWithProgressContext(ctx context.Context) <-chan Progress {
 
 	size := 100_000
 
+	s.mu.RLock()
 	data := []types.Money{0}
-	for _, payment := range s.payments {
+	for _, payment := range s.store().Payments() {
 		data = append(data, payment.Amount)
 	}
+	s.mu.RUnlock()
 
 	goroutines := 1 + len(data)/size
 
@@ -767,11 +1193,16 @@ func (s *Service) SumPaymentsWithProgress() <-chan Progress {
 			highIndex = len(data)
 		}
 
-		ch := make(chan Progress)
+		// every goroutine sends a single part,
+		// which is kept by the channel until it is read.
+		ch := make(chan Progress, 1)
 		go func(ch chan<- Progress, data []types.Money) {
 			defer close(ch)
 			sum := types.Money(0)
-			for _, v := range data {
+			for i, v := range data {
+				if i%cancelCheck == 0 && ctx.Err() != nil {
+					return
+				}
 				sum += v
 			}
 			ch <- Progress{
@@ -781,25 +1212,50 @@ func (s *Service) SumPaymentsWithProgress() <-chan Progress {
 		}(ch, data[lowIndex:highIndex])
 		channels[i] = ch
 	}
-	return Merge(channels)
+	return mergeContext(ctx, channels, goroutines)
 }
 
 // Merge - creates a channel, in which messages from all channels appear,
 // which are sent in a slice.
 func Merge(channels []<-chan Progress) <-chan Progress {
+	return MergeContext(context.Background(), channels)
+}
+
+// MergeContext - merges the channels like Merge. When the context is done,
+// the values are no more read from the channels and the common channel
+// is closed, the senders to the channels must stop by themselves.
+func MergeContext(ctx context.Context, channels []<-chan Progress) <-chan Progress {
+	return mergeContext(ctx, channels, 0)
+}
+
+// mergeContext - merges the channels into the common one with the buffer
+// of the size.
+func mergeContext(ctx context.Context, channels []<-chan Progress, size int) <-chan Progress {
 	wg := sync.WaitGroup{}
 	wg.Add(len(channels))
 
-	merged := make(chan Progress)
+	merged := make(chan Progress, size)
 
 	for _, ch := range channels {
 		// a goroutine is launched for each channel,
 		// which subtracts the values from this channel and throws it into the common.
 		go func(ch <-chan Progress) {
 			defer wg.Done()
-			// when the channel is closed, we will exit the loop.
-			for val := range ch {
-				merged <- val
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case val, ok := <-ch:
+					// when the channel is closed, we will exit the loop.
+					if !ok {
+						return
+					}
+					select {
+					case merged <- val:
+					case <-ctx.Done():
+						return
+					}
+				}
 			}
 		}(ch)
 	}
@@ -1,10 +1,19 @@
 package wallet
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/SardorMS/wallet/pkg/types"
 	"github.com/google/uuid"
@@ -18,6 +27,12 @@ func newTestService() *testService {
 	return &testService{Service: &Service{}}
 }
 
+// memory - returns the storage of the test service, for the tests
+// which put the data there directly.
+func (s *testService) memory() *MemoryStorage {
+	return s.store().(*MemoryStorage)
+}
+
 type testAccount struct {
 	phone    types.Phone
 	balance  types.Money
@@ -68,6 +83,12 @@ func (s *Service) addAccount(data testAccount) (*types.Account, []*types.Payment
 			return nil, nil, nil, fmt.Errorf("can't make favorite paymnet, error = %v", err)
 		}
 	}
+
+	// the balance after the deposit and the payments.
+	account, err = s.FindAccountByID(account.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	return account, payments, favorites, nil
 }
 
@@ -267,6 +288,11 @@ func TestService_Repeat_success(t *testing.T) {
 
 	// trying to cancel the payment
 	payment := payments[0]
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
 	// trying to repeat the payment
 	newPayment, err := s.Repeat(payment.ID)
@@ -290,8 +316,8 @@ func TestService_Repeat_success(t *testing.T) {
 		return
 	}
 
-	if newPayment.Status != payment.Status {
-		t.Errorf("Repeat(): status of payments difference,\n Repeated payment = %v,\n Rejected payment = %v", newPayment, payment)
+	if newPayment.Status != types.PaymentStatusInProgress {
+		t.Errorf("Repeat(): status of the new payment is not in progress,\n Repeated payment = %v,\n Rejected payment = %v", newPayment, payment)
 		return
 	}
 }
@@ -459,7 +485,7 @@ func TestService_ExportToFile_success(t *testing.T) {
 		return
 	}
 
-	err = s.ExportToFile("data1/hello.txt")
+	err = s.ExportToFile(t.TempDir() + "/hello.txt")
 	if err != nil {
 		t.Error(err)
 		return
@@ -519,7 +545,7 @@ func TestService_Export(t *testing.T) {
 		return
 	}
 
-	err = s.Export("data")
+	err = s.Export(t.TempDir())
 	if err != nil {
 		t.Error(err)
 		return
@@ -581,17 +607,18 @@ func TestService_Import_Error(t *testing.T) {
 
 func TestService_Import_emptyFiles(t *testing.T) {
 	s := newTestService()
+	dir := t.TempDir()
 
-	file1, _ := os.Create("data1/accounts.dump")
+	file1, _ := os.Create(dir + "/accounts.dump")
 	defer file1.Close()
 
-	file2, _ := os.Create("data1/payments.dump")
+	file2, _ := os.Create(dir + "/payments.dump")
 	defer file2.Close()
 
-	file3, _ := os.Create("data1/favorites.dump")
+	file3, _ := os.Create(dir + "/favorites.dump")
 	defer file3.Close()
 
-	err := s.Import("data1")
+	err := s.Import(dir)
 	if err != nil {
 		t.Error(err)
 		return
@@ -673,7 +700,7 @@ func TestService_HistoryToFiles_success1(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = s.HistoryToFiles(payments, "data", 3)
+	err = s.HistoryToFiles(payments, t.TempDir(), 3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -686,7 +713,7 @@ func TestService_HistoryToFiles_success2(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = s.HistoryToFiles(payments, "data", 12)
+	err = s.HistoryToFiles(payments, t.TempDir(), 12)
 	if err != nil {
 		t.Error(err)
 	}
@@ -697,7 +724,7 @@ func TestService_HistoryToFiles_notSuccess1(t *testing.T) {
 	Transactions(s)
 
 	payment := []types.Payment{}
-	err := s.HistoryToFiles(payment, "data", 12)
+	err := s.HistoryToFiles(payment, t.TempDir(), 12)
 	if err != nil {
 		t.Error(err)
 	}
@@ -828,7 +855,7 @@ func TestService_SumPaymentsWithProgress_success1(t *testing.T) {
 		payments = append(payments, payment)
 	}
 
-	s.payments = payments
+	s.memory().payments = payments
 
 	want := types.Money(1_000_000)
 	result := types.Money(0)
@@ -856,7 +883,7 @@ func TestService_SumPaymentsWithProgress_success2(t *testing.T) {
 		payments = append(payments, payment)
 	}
 
-	s.payments = payments
+	s.memory().payments = payments
 
 	want := types.Money(0)
 	result := types.Money(0)
@@ -886,7 +913,7 @@ func BenchmarkSumPaymentsWithProgress(b *testing.B) {
 		payments = append(payments, payment)
 	}
 
-	s.payments = payments
+	s.memory().payments = payments
 	for i := 0; i < b.N; i++ {
 		result := types.Money(0)
 		for j := range s.SumPaymentsWithProgress() {
@@ -899,3 +926,1450 @@ func BenchmarkSumPaymentsWithProgress(b *testing.B) {
 		}
 	}
 }
+
+func TestService_Transfer_success(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	transfer, err := s.Transfer(1, 2, 100)
+	if err != nil {
+		t.Errorf("Transfer(): error = %v", err)
+		return
+	}
+
+	from, _ := s.FindAccountByID(1)
+	to, _ := s.FindAccountByID(2)
+	if from.Balance != 150 || to.Balance != 260 {
+		t.Errorf("Transfer(): wrong balances, from = %v, to = %v", from, to)
+		return
+	}
+
+	savedTransfer, err := s.FindTransferByID(transfer.ID)
+	if err != nil {
+		t.Errorf("Transfer(): can't find transfer by id, error = %v", err)
+		return
+	}
+
+	if savedTransfer.FromAccountID != 1 || savedTransfer.ToAccountID != 2 {
+		t.Errorf("Transfer(): wrong accounts in transfer = %v", savedTransfer)
+	}
+}
+
+func TestService_Transfer_notSuccess(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	_, err := s.Transfer(2, 1, 1000)
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Transfer(): must return ErrNotEnoughBalance, returned = %v", err)
+	}
+
+	_, err = s.Transfer(1, 1, 10)
+	if err != ErrSameAccount {
+		t.Errorf("Transfer(): must return ErrSameAccount, returned = %v", err)
+	}
+
+	_, err = s.Transfer(1, 4, 10)
+	if err != ErrAccountNotFound {
+		t.Errorf("Transfer(): must return ErrAccountNotFound, returned = %v", err)
+	}
+
+	from, _ := s.FindAccountByID(1)
+	if from.Balance != 250 {
+		t.Errorf("Transfer(): balance changed after failed transfer = %v", from)
+	}
+}
+
+func TestService_RejectTransfer_success(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	transfer, err := s.Transfer(1, 2, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.RejectTransfer(transfer.ID)
+	if err != nil {
+		t.Errorf("RejectTransfer(): error = %v", err)
+		return
+	}
+
+	transfer, _ = s.FindTransferByID(transfer.ID)
+	if transfer.Status != types.PaymentStatusFail {
+		t.Errorf("RejectTransfer(): status didn't change, transfer = %v", transfer)
+	}
+
+	from, _ := s.FindAccountByID(1)
+	to, _ := s.FindAccountByID(2)
+	if from.Balance != 250 || to.Balance != 160 {
+		t.Errorf("RejectTransfer(): wrong balances, from = %v, to = %v", from, to)
+	}
+}
+
+func TestService_RejectTransfer_notFound(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	err := s.RejectTransfer(uuid.New().String())
+	if err != ErrTransferNotFound {
+		t.Errorf("RejectTransfer(): must return ErrTransferNotFound, returned = %v", err)
+	}
+}
+
+func TestService_Import_transfers(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	transfer, err := s.Transfer(1, 3, 50)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := imported.FindTransferByID(transfer.ID)
+	if err != nil {
+		t.Errorf("Import(): can't find transfer by id, error = %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(result, transfer) {
+		t.Errorf("Import(): wrong transfer imported = %v, want = %v", result, transfer)
+	}
+}
+
+func TestService_Confirm_success(t *testing.T) {
+	s := newTestService()
+	_, payments, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment := payments[0]
+	err = s.Confirm(payment.ID)
+	if err != nil {
+		t.Errorf("Confirm(): error = %v", err)
+		return
+	}
+
+	payment, _ = s.FindPaymentByID(payment.ID)
+	if payment.Status != types.PaymentStatusOK {
+		t.Errorf("Confirm(): status didn't change, payment = %v", payment)
+	}
+}
+
+func TestService_Confirm_notFound(t *testing.T) {
+	s := newTestService()
+	err := s.Confirm(uuid.New().String())
+	if err != ErrPaymentNotFound {
+		t.Errorf("Confirm(): must return ErrPaymentNotFound, returned = %v", err)
+	}
+}
+
+func TestService_Reject_completed(t *testing.T) {
+	s := newTestService()
+	_, payments, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment := payments[0]
+	err = s.Confirm(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(payment.ID)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) {
+		t.Errorf("Reject(): must return TransitionError, returned = %v", err)
+		return
+	}
+
+	if transitionErr.From != types.PaymentStatusOK || transitionErr.To != types.PaymentStatusFail {
+		t.Errorf("Reject(): wrong transition error = %v", transitionErr)
+	}
+
+	account, _ := s.FindAccountByID(payment.AccountID)
+	if account.Balance != defaultTestAccount.balance-payment.Amount {
+		t.Errorf("Reject(): balance changed for completed payment = %v", account)
+	}
+}
+
+func TestService_Reject_twice(t *testing.T) {
+	s := newTestService()
+	_, payments, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment := payments[0]
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(payment.ID)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Reject(): must return ErrInvalidTransition, returned = %v", err)
+	}
+
+	account, _ := s.FindAccountByID(payment.AccountID)
+	if account.Balance != defaultTestAccount.balance {
+		t.Errorf("Reject(): payment refunded twice, account = %v", account)
+	}
+}
+
+func TestService_Repeat_invalidStatus(t *testing.T) {
+	s := newTestService()
+	_, payments, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment := payments[0]
+	s.memory().paymentsByID[payment.ID].Status = "UNKNOWN"
+	_, err = s.Repeat(payment.ID)
+	if err != ErrInvalidStatus {
+		t.Errorf("Repeat(): must return ErrInvalidStatus, returned = %v", err)
+	}
+}
+
+func TestService_Repeat_notFinished(t *testing.T) {
+	s := newTestService()
+	_, payments, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the payment is still in progress.
+	payment := payments[0]
+	_, err = s.Repeat(payment.ID)
+	var repeatErr *RepeatError
+	if !errors.As(err, &repeatErr) || repeatErr.Status != types.PaymentStatusInProgress || !errors.Is(err, ErrNotRepeatable) {
+		t.Errorf("Repeat(): must return RepeatError, returned = %v", err)
+	}
+
+	if len(s.store().Payments()) != 1 {
+		t.Errorf("Repeat(): payment repeated = %v", s.store().Payments())
+	}
+
+	for _, status := range []types.PaymentStatus{types.PaymentStatusOK, types.PaymentStatusFail} {
+		if !status.CanRepeat() {
+			t.Errorf("CanRepeat(%s): finished payment must be repeatable", status)
+		}
+	}
+}
+
+func TestService_RejectTransfer_confirmed(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	transfer, err := s.Transfer(1, 2, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.ConfirmTransfer(transfer.ID)
+	if err != nil {
+		t.Errorf("ConfirmTransfer(): error = %v", err)
+		return
+	}
+
+	err = s.RejectTransfer(transfer.ID)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("RejectTransfer(): must return ErrInvalidTransition, returned = %v", err)
+	}
+}
+
+func TestService_Import_invalidTransition(t *testing.T) {
+	s := newTestService()
+	_, payments, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the payment is already completed in memory, the dump still says INPROGRESS.
+	payment := payments[0]
+	err = s.Confirm(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Import(dir)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Import(): must return ErrInvalidTransition, returned = %v", err)
+	}
+
+	payment, _ = s.FindPaymentByID(payment.ID)
+	if payment.Status != types.PaymentStatusOK {
+		t.Errorf("Import(): status of completed payment changed = %v", payment)
+	}
+}
+
+func TestService_Import_invalidStatus(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/payments.dump", []byte("1;1;100;auto;DONE\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.Import(dir)
+	if !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("Import(): must return ErrInvalidStatus, returned = %v", err)
+	}
+
+	_, err = s.FindPaymentByID("1")
+	if err != ErrPaymentNotFound {
+		t.Errorf("Import(): payment with invalid status imported, error = %v", err)
+	}
+}
+
+func TestService_returnedRecords_concurrentWrites(t *testing.T) {
+	s := newTestService()
+	account, err := s.RegisterAccount("+1")
+	if err == nil {
+		err = s.Deposit(account.ID, 1_000)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(account.ID, 1, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, _ = s.FindAccountByID(account.ID)
+	found, _ := s.FindPaymentByID(payment.ID)
+
+	// the records returned before are read while the service changes
+	// the same records, go test -race reports it if they are shared.
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for j := 0; j < 100; j++ {
+			s.Deposit(account.ID, 1)
+			s.Pay(account.ID, 1, "auto")
+		}
+		s.Confirm(payment.ID)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if account.Balance != 999 || payment.Status != types.PaymentStatusInProgress || found.Updated != payment.Updated {
+				t.Errorf("returned records changed by the service: %v %v", account, payment)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// the changes are visible to the new reads only.
+	payment, _ = s.FindPaymentByID(payment.ID)
+	if payment.Status != types.PaymentStatusOK {
+		t.Errorf("Confirm(): status didn't change, payment = %v", payment)
+	}
+
+	// the caller may change the returned record, the service keeps its own.
+	payment.Status = types.PaymentStatusFail
+	found, _ = s.FindPaymentByID(payment.ID)
+	if found.Status != types.PaymentStatusOK {
+		t.Errorf("FindPaymentByID(): record of the service changed by the caller = %v", found)
+	}
+}
+
+func TestService_concurrentAccess(t *testing.T) {
+	s := newTestService()
+	accounts := 4
+	for i := 1; i <= accounts; i++ {
+		s.RegisterAccount(types.Phone("+" + strconv.Itoa(i)))
+		s.Deposit(int64(i), 1_000)
+	}
+
+	dir := t.TempDir()
+	wg := sync.WaitGroup{}
+	for i := 1; i <= accounts; i++ {
+		wg.Add(2)
+		go func(accountID int64) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				payment, err := s.Pay(accountID, 1, "auto")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if j%2 == 0 {
+					err = s.Reject(payment.ID)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(int64(i))
+
+		go func(accountID int64) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				err := s.Deposit(accountID, 1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(int64(i))
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			err := s.Export(dir)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s.SumPayments(4)
+			s.FilterPayments(1, 4)
+			s.FilterPaymentsByFn(FilterCategory, 4)
+			for range s.SumPaymentsWithProgress() {
+			}
+		}
+	}()
+	wg.Wait()
+
+	for i := 1; i <= accounts; i++ {
+		account, err := s.FindAccountByID(int64(i))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// 1000 deposited at start, 100 more by single units, 50 payments kept.
+		if account.Balance != 1_050 {
+			t.Errorf("concurrent access: wrong balance, account = %v", account)
+		}
+	}
+
+	if sum := s.SumPayments(4); sum != types.Money(accounts*100) {
+		t.Errorf("concurrent access: wrong sum of payments = %v", sum)
+	}
+}
+
+func TestService_FilterPaymentsByFn_callsService(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	// the filter uses the service itself, this must not deadlock.
+	payments, err := s.FilterPaymentsByFn(func(payment types.Payment) bool {
+		account, err := s.FindAccountByID(payment.AccountID)
+		return err == nil && account.Phone == "2222"
+	}, 4)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(payments) != 1 {
+		t.Errorf("FilterPaymentsByFn(): wrong payments = %v", payments)
+	}
+}
+
+func TestService_RegisterAccount_afterImport(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = imported.RegisterAccount("2222")
+	if err != ErrPhoneRegistered {
+		t.Errorf("RegisterAccount(): must return ErrPhoneRegistered, returned = %v", err)
+	}
+
+	payments, err := imported.ExportAccountHistory(3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(payments) != 3 {
+		t.Errorf("ExportAccountHistory(): wrong payments after import = %v", payments)
+	}
+}
+
+func TestService_Import_changedAccount(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	payment := s.memory().payments[0]
+	err := os.WriteFile(dir+"/payments.dump", []byte(payment.ID+";2;10;food;INPROGRESS\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the payment moved from the first account to the second one.
+	payments, _ := s.ExportAccountHistory(1)
+	if len(payments) != 7 {
+		t.Errorf("Import(): payment wasn't removed from old account, payments = %v", payments)
+	}
+
+	payments, _ = s.ExportAccountHistory(2)
+	if len(payments) != 2 {
+		t.Errorf("Import(): payment wasn't added to new account, payments = %v", payments)
+	}
+}
+
+// benchmarkService - creates a service with the given number of accounts,
+// each with the given number of payments.
+func benchmarkService(b *testing.B, accounts, payments int) *Service {
+	s := &Service{}
+	for i := 1; i <= accounts; i++ {
+		account, err := s.RegisterAccount(types.Phone("+" + strconv.Itoa(i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if payments == 0 {
+			continue
+		}
+		err = s.Deposit(account.ID, types.Money(payments))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < payments; j++ {
+			_, err = s.Pay(account.ID, 1, "auto")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return s
+}
+
+// findPaymentByScan - the lookup as it was done before the indexes.
+func findPaymentByScan(s *Service, paymentID string) (*types.Payment, error) {
+	for _, payment := range s.store().Payments() {
+		if payment.ID == paymentID {
+			return payment, nil
+		}
+	}
+	return nil, ErrPaymentNotFound
+}
+
+// findAccountByScan - the lookup as it was done before the indexes.
+func findAccountByScan(s *Service, accountID int64) (*types.Account, error) {
+	for _, account := range s.store().Accounts() {
+		if account.ID == accountID {
+			return account, nil
+		}
+	}
+	return nil, ErrAccountNotFound
+}
+
+func BenchmarkFindPaymentByID_index(b *testing.B) {
+	s := benchmarkService(b, 100, 1_000)
+	payments := s.store().Payments()
+	paymentID := payments[len(payments)-1].ID
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := s.FindPaymentByID(paymentID)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindPaymentByID_scan(b *testing.B) {
+	s := benchmarkService(b, 100, 1_000)
+	payments := s.store().Payments()
+	paymentID := payments[len(payments)-1].ID
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := findPaymentByScan(s, paymentID)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindAccountByID_index(b *testing.B) {
+	s := benchmarkService(b, 10_000, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := s.FindAccountByID(10_000)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindAccountByID_scan(b *testing.B) {
+	s := benchmarkService(b, 10_000, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := findAccountByScan(s, 10_000)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// testClock - returns a clock which starts at the given time
+// and moves one minute forward on each call.
+func testClock(start time.Time) func() time.Time {
+	now := start.Add(-time.Minute)
+	return func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+}
+
+var testTime = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestService_Pay_timestamps(t *testing.T) {
+	s := newTestService()
+	s.SetClock(testClock(testTime))
+	_, payments, favorites, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// deposit at 12:00, payment at 12:01, favorite at 12:02
+	payment := payments[0]
+	if !payment.Created.Equal(testTime.Add(time.Minute)) || !payment.Updated.Equal(payment.Created) {
+		t.Errorf("Pay(): wrong timestamps, payment = %v", payment)
+	}
+
+	if !favorites[0].Created.Equal(testTime.Add(2 * time.Minute)) {
+		t.Errorf("FavoritePayment(): wrong timestamp, favorite = %v", favorites[0])
+	}
+
+	err = s.Confirm(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, _ = s.FindPaymentByID(payment.ID)
+	if !payment.Updated.Equal(testTime.Add(3*time.Minute)) || !payment.Created.Equal(testTime.Add(time.Minute)) {
+		t.Errorf("Confirm(): wrong timestamps, payment = %v", payment)
+	}
+}
+
+func TestService_ExportAccountDeposits_success(t *testing.T) {
+	s := newTestService()
+	s.SetClock(testClock(testTime))
+	Transactions(s)
+
+	err := s.Deposit(1, 50)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	deposits, err := s.ExportAccountDeposits(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(deposits) != 2 || deposits[0].Amount != 500 || deposits[1].Amount != 50 {
+		t.Errorf("ExportAccountDeposits(): wrong deposits = %v", deposits)
+		return
+	}
+
+	if !deposits[0].Created.Equal(testTime) {
+		t.Errorf("ExportAccountDeposits(): wrong timestamp, deposit = %v", deposits[0])
+	}
+}
+
+func TestService_ExportAccountDeposits_notFound(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	_, err := s.ExportAccountDeposits(4)
+	if err != ErrAccountNotFound {
+		t.Errorf("ExportAccountDeposits(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
+
+func TestService_Import_timestamps(t *testing.T) {
+	s := newTestService()
+	s.SetClock(testClock(testTime))
+	_, payments, favorites, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := imported.FindPaymentByID(payments[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(payment, payments[0]) {
+		t.Errorf("Import(): wrong payment = %v, want = %v", payment, payments[0])
+	}
+
+	favorite, err := imported.FindFavoriteByID(favorites[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(favorite, favorites[0]) {
+		t.Errorf("Import(): wrong favorite = %v, want = %v", favorite, favorites[0])
+	}
+
+	deposits, _ := s.ExportAccountDeposits(1)
+	importedDeposits, _ := imported.ExportAccountDeposits(1)
+	if !reflect.DeepEqual(importedDeposits, deposits) {
+		t.Errorf("Import(): wrong deposits = %v, want = %v", importedDeposits, deposits)
+	}
+}
+
+func TestService_Import_withoutTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/payments.dump", []byte("1;1;100;auto;INPROGRESS\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.FindPaymentByID("1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if payment.Amount != 100 || !payment.Created.IsZero() || !payment.Updated.IsZero() {
+		t.Errorf("Import(): wrong payment from old dump = %v", payment)
+	}
+}
+
+func TestService_HistoryToFiles_timestamps(t *testing.T) {
+	s := newTestService()
+	s.SetClock(testClock(testTime))
+	Transactions(s)
+
+	payments, err := s.ExportAccountHistory(2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.HistoryToFiles(payments, dir, 10)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := os.ReadFile(dir + "/payments.dump")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lines, _, ferr := decodeDump(data)
+	if ferr != nil {
+		t.Error(ferr)
+		return
+	}
+
+	created := strconv.FormatInt(payments[0].Created.UnixNano(), 10)
+	want := payments[0].ID + ";2;40;phone;INPROGRESS;" + created + ";" + created
+	if len(lines) != 1 || lines[0].text != want {
+		t.Errorf("HistoryToFiles(): wrong data = %q, want = %q", data, want)
+	}
+}
+
+func TestService_AccountHistory_success(t *testing.T) {
+	s := newTestService()
+	_, payments, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(payments[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	entries, err := s.AccountHistory(1)
+	if err != nil {
+		t.Errorf("AccountHistory(): error = %v", err)
+		return
+	}
+
+	want := []struct {
+		kind    types.EntryType
+		amount  types.Money
+		balance types.Money
+	}{
+		{kind: types.EntryDeposit, amount: 500, balance: 500},
+		{kind: types.EntryPayment, amount: -100, balance: 400},
+		{kind: types.EntryRefund, amount: 100, balance: 500},
+	}
+
+	if len(entries) != len(want) {
+		t.Errorf("AccountHistory(): wrong entries = %v", entries)
+		return
+	}
+
+	for i, entry := range entries {
+		if entry.Type != want[i].kind || entry.Amount != want[i].amount || entry.Balance != want[i].balance {
+			t.Errorf("AccountHistory(): wrong entry #%v = %v", i, entry)
+		}
+	}
+
+	if entries[1].Reference != payments[0].ID || entries[2].Reference != payments[0].ID {
+		t.Errorf("AccountHistory(): entries don't refer to the payment = %v", entries)
+	}
+}
+
+func TestService_AccountHistory_transfer(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	transfer, err := s.Transfer(1, 2, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.RejectTransfer(transfer.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	entries, err := s.AccountHistory(2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// deposit, payment, transfer in, reversal
+	if len(entries) != 4 {
+		t.Errorf("AccountHistory(): wrong entries = %v", entries)
+		return
+	}
+
+	if entries[2].Type != types.EntryTransferIn || entries[2].Balance != 260 {
+		t.Errorf("AccountHistory(): wrong transfer entry = %v", entries[2])
+	}
+
+	if entries[3].Type != types.EntryReversal || entries[3].Balance != 160 {
+		t.Errorf("AccountHistory(): wrong reversal entry = %v", entries[3])
+	}
+}
+
+func TestService_AccountHistory_notFound(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	_, err := s.AccountHistory(4)
+	if err != ErrAccountNotFound {
+		t.Errorf("AccountHistory(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
+
+func TestService_Import_ledger(t *testing.T) {
+	s := newTestService()
+	s.SetClock(testClock(testTime))
+	Transactions(s)
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// importing twice must not duplicate the entries.
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for id := int64(1); id <= 3; id++ {
+		want, _ := s.AccountHistory(id)
+		result, err := imported.AccountHistory(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !reflect.DeepEqual(result, want) {
+			t.Errorf("Import(): wrong history = %v, want = %v", result, want)
+		}
+	}
+}
+
+func TestService_Export_generations(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Pay(2, 60, "food")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	current, err := os.ReadFile(dir + "/CURRENT")
+	if err != nil || string(current) != "gen-000002\n" {
+		t.Errorf("Export(): wrong CURRENT = %q, error = %v", current, err)
+	}
+
+	if _, err := os.Stat(dir + "/gen-000001"); !os.IsNotExist(err) {
+		t.Errorf("Export(): old generation wasn't removed, error = %v", err)
+	}
+
+	// the files of the older dumps left in the directory are not read.
+	err = os.WriteFile(dir+"/accounts.dump", []byte("2;2222;1000\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := imported.FindAccountByID(2)
+	if err != nil || account.Balance != 100 {
+		t.Errorf("Import(): wrong account = %v, error = %v", account, err)
+	}
+
+	payments, _ := imported.ExportAccountHistory(2)
+	if len(payments) != 2 {
+		t.Errorf("Import(): wrong payments = %v", payments)
+	}
+}
+
+func TestService_Export_concurrent(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	errs := make(chan error, 8)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.Export(dir)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Export(): error = %v", err)
+		}
+	}
+
+	// every export wrote its own generation, only the current one is left.
+	current, err := os.ReadFile(dir + "/CURRENT")
+	if err != nil || string(current) != "gen-000008\n" {
+		t.Errorf("Export(): wrong CURRENT = %q, error = %v", current, err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("Export(): wrong files left = %v", entries)
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil || len(imported.store().Payments()) != len(s.store().Payments()) {
+		t.Errorf("Import(): wrong payments, error = %v", err)
+	}
+}
+
+func TestService_Import_snapshotNotFound(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	generation := dir + "/gen-000001"
+	missingFile := func() error { return os.Remove(dumpPath(generation, kindPayment)) }
+	missingGeneration := func() error { return os.RemoveAll(generation) }
+
+	for _, mode := range []ImportMode{ImportLenient, ImportStrict} {
+		imported := newTestService()
+		imported.SetImportMode(mode)
+
+		err = imported.Import(dir + "/missing")
+		if !errors.Is(err, ErrSnapshotNotFound) {
+			t.Errorf("Import(%v): must return ErrSnapshotNotFound for no directory, returned = %v", mode, err)
+		}
+	}
+
+	for _, remove := range []func() error{missingFile, missingGeneration} {
+		err = remove()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, mode := range []ImportMode{ImportLenient, ImportStrict} {
+			imported := newTestService()
+			imported.SetImportMode(mode)
+
+			err = imported.Import(dir)
+			if !errors.Is(err, ErrSnapshotNotFound) || len(imported.store().Accounts()) != 0 {
+				t.Errorf("Import(%v): must return ErrSnapshotNotFound, returned = %v", mode, err)
+			}
+		}
+	}
+}
+
+func TestService_Export_mkdirFails(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/file", nil, 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Export(dir + "/file/dump")
+	if err == nil {
+		t.Error("Export(): must return error when the directory can't be created")
+	}
+}
+
+func TestService_Export_failedAttemptLeftovers(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	dir := t.TempDir()
+	err := s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the generation which was being written when the previous export failed.
+	err = os.MkdirAll(dir+"/gen-000002", 0777)
+	if err == nil {
+		err = os.WriteFile(dir+"/gen-000002/accounts.dump", []byte("1;1111;1\n"), 0666)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	err = imported.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := imported.FindAccountByID(1)
+	if err != nil || account.Balance != 250 {
+		t.Errorf("Import(): unfinished generation was read, account = %v, error = %v", account, err)
+	}
+
+	err = s.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := os.ReadFile(dir + "/gen-000002/accounts.dump")
+	if err != nil || !strings.Contains(string(data), "\n1;1111;250\n") {
+		t.Errorf("Export(): leftovers weren't replaced, data = %q, error = %v", data, err)
+	}
+}
+
+// testFiles - keeps the files written by HistoryToWriters in memory.
+type testFiles map[string]*bytes.Buffer
+
+// testFile - the writer of the file of testFiles.
+type testFile struct {
+	*bytes.Buffer
+}
+
+// Close - implements io.Closer.
+func (f testFile) Close() error {
+	return nil
+}
+
+func (files testFiles) create(name string) (io.WriteCloser, error) {
+	if _, ok := files[name]; ok {
+		return nil, fmt.Errorf("file %s is written twice", name)
+	}
+	files[name] = &bytes.Buffer{}
+	return testFile{files[name]}, nil
+}
+
+// failingWriter - the writer which always fails.
+type failingWriter struct{}
+
+var errWriteFailed = errors.New("write failed")
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWriteFailed
+}
+
+func TestService_ExportToWriter_roundTrip(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	buf := &bytes.Buffer{}
+	err := s.ExportToWriter(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if buf.String() != "1;1111;250|2;2222;160|3;3333;227" {
+		t.Errorf("ExportToWriter(): wrong data = %q", buf)
+	}
+
+	imported := newTestService()
+	err = imported.ImportFromReader(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := imported.FindAccountByID(3)
+	if err != nil || account.Balance != 227 {
+		t.Errorf("ImportFromReader(): wrong account = %v, error = %v", account, err)
+	}
+
+	err = imported.ImportFromReader(strings.NewReader("4;4444;abc"))
+	if err == nil || err.Error() != "1 record(s) rejected:\nline 1: field balance: \"abc\" is not a number" {
+		t.Errorf("ImportFromReader(): wrong error = %v", err)
+	}
+
+	err = s.ExportToWriter(failingWriter{})
+	if err != errWriteFailed {
+		t.Errorf("ExportToWriter(): must return the error of the writer, returned = %v", err)
+	}
+}
+
+func TestService_ExportDump_roundTrip(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	_, err := s.Transfer(1, 2, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.ExportDump(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := newTestService()
+	imported.SetImportMode(ImportStrict)
+	err = imported.ImportDump(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(takeSnapshot(imported.store()), takeSnapshot(s.store())) {
+		t.Errorf("ImportDump(): wrong records imported")
+	}
+
+	err = imported.ImportDump(strings.NewReader("not an archive"))
+	if err == nil {
+		t.Errorf("ImportDump(): broken archive imported")
+	}
+
+	err = s.ExportDump(failingWriter{})
+	if err != errWriteFailed {
+		t.Errorf("ExportDump(): must return the error of the writer, returned = %v", err)
+	}
+}
+
+func TestService_HistoryToWriters(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	payments, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	files := testFiles{}
+	err = s.HistoryToWriters(payments, 3, files.create)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// three shards and the manifest.
+	if len(files) != 4 || files[manifestFile] == nil {
+		t.Errorf("HistoryToWriters(): wrong files = %v", files)
+		return
+	}
+
+	count := 0
+	for name, buf := range files {
+		lines, _, ferr := decodeDump(buf.Bytes())
+		if ferr != nil {
+			t.Errorf("HistoryToWriters(): file %s is broken, error = %v", name, ferr)
+		}
+		if name != manifestFile {
+			count += len(lines)
+		}
+	}
+
+	if count != len(payments) {
+		t.Errorf("HistoryToWriters(): wrong number of payments = %v", count)
+	}
+
+	err = s.HistoryToWriters(payments, 3, func(name string) (io.WriteCloser, error) {
+		return nil, errWriteFailed
+	})
+	if err != errWriteFailed {
+		t.Errorf("HistoryToWriters(): must return the error of create, returned = %v", err)
+	}
+}
+
+// checkGoroutines - fails the test if the number of goroutines doesn't
+// come back to the number before the test within a second.
+func checkGoroutines(t *testing.T, before int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Errorf("goroutines leaked: %d, before the test %d", runtime.NumGoroutine(), before)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestService_SumPaymentsContext(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	sum, err := s.SumPaymentsContext(context.Background(), 3)
+	if err != nil || sum != s.SumPayments(3) {
+		t.Errorf("SumPaymentsContext(): wrong sum = %v, error = %v", sum, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = s.SumPaymentsContext(ctx, 3)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("SumPaymentsContext(): must return context.Canceled, returned = %v", err)
+	}
+
+	_, err = s.FilterPaymentsContext(ctx, 1, 3)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("FilterPaymentsContext(): must return context.Canceled, returned = %v", err)
+	}
+}
+
+func TestService_FilterPaymentsByFnContext_slowFilter(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+	before := runtime.NumGoroutine()
+
+	release := make(chan struct{})
+	filter := func(payment types.Payment) bool {
+		<-release
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	payments, err := s.FilterPaymentsByFnContext(ctx, filter, 4)
+	if !errors.Is(err, context.DeadlineExceeded) || payments != nil {
+		t.Errorf("FilterPaymentsByFnContext(): must return context.DeadlineExceeded, returned = %v %v", payments, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("FilterPaymentsByFnContext(): returned after %v", elapsed)
+	}
+
+	// the workers stop after the calls of the filter they are in.
+	close(release)
+	checkGoroutines(t, before)
+}
+
+func TestService_SumPaymentsWithProgress_notRead(t *testing.T) {
+	s := benchmarkStorageService(350_000)
+	before := runtime.NumGoroutine()
+
+	s.SumPaymentsWithProgress()
+	checkGoroutines(t, before)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := s.SumPaymentsWithProgressContext(ctx)
+	<-ch
+	cancel()
+	checkGoroutines(t, before)
+
+	parts := 0
+	for range ch {
+		parts++
+	}
+	if parts > 3 {
+		t.Errorf("SumPaymentsWithProgressContext(): wrong parts after the first one = %v", parts)
+	}
+}
+
+func TestMergeContext_cancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// the sender stops with the context as well.
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan Progress)
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case ch <- Progress{Part: 1, Result: 1}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	merged := MergeContext(ctx, []<-chan Progress{ch})
+	<-merged
+	cancel()
+
+	for range merged {
+	}
+	checkGoroutines(t, before)
+}
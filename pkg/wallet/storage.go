@@ -0,0 +1,633 @@
+package wallet
+
+import (
+	"github.com/SardorMS/wallet/pkg/types"
+	"github.com/google/uuid"
+)
+
+// Storage - describes the place where the service keeps its data.
+//
+// The service calls the storage under its own lock: reads may be called
+// concurrently with each other, but never together with Commit.
+// The returned records belong to the storage and must not be changed,
+// all changes are made through transactions.
+type Storage interface {
+	Account(id int64) (*types.Account, error)
+	AccountByPhone(phone types.Phone) (*types.Account, error)
+	Accounts() []*types.Account
+
+	Payment(id string) (*types.Payment, error)
+	Payments() []*types.Payment
+	PaymentsByAccount(accountID int64) []*types.Payment
+
+	Favorite(id string) (*types.Favorite, error)
+	Favorites() []*types.Favorite
+	FavoritesByAccount(accountID int64) []*types.Favorite
+
+	Transfer(id string) (*types.Transfer, error)
+	Transfers() []*types.Transfer
+
+	Deposits() []*types.Deposit
+	DepositsByAccount(accountID int64) []*types.Deposit
+
+	Postings() []*types.Posting
+	PostingsByLedger(account types.LedgerAccount) []*types.Posting
+	LedgerBalance(account types.LedgerAccount) types.Money
+
+	IdempotencyKey(key string) (*types.IdempotencyKey, error)
+	IdempotencyKeys() []*types.IdempotencyKey
+
+	Begin() Tx
+}
+
+// Tx - describes a set of changes of the storage, which are applied
+// all together by Commit or not at all. Reads of the storage don't see
+// the changes of the transaction until it is committed.
+//
+// Saving a record with the ID of an existing one replaces it.
+type Tx interface {
+	SaveAccount(account types.Account)
+	SavePayment(payment types.Payment)
+	SaveFavorite(favorite types.Favorite)
+	SaveTransfer(transfer types.Transfer)
+	SaveDeposit(deposit types.Deposit)
+	SavePosting(posting types.Posting)
+	SaveIdempotencyKey(key types.IdempotencyKey)
+
+	DeleteAccount(id int64)
+	DeletePayment(id string)
+	DeleteFavorite(id string)
+	DeleteTransfer(id string)
+	DeleteDeposit(id string)
+	DeletePosting(id string)
+
+	Commit() error
+	Rollback()
+}
+
+// recordKind - the kind of the stored record, also the name of its dump file.
+type recordKind string
+
+// Kinds of the stored records.
+const (
+	kindAccount  recordKind = "accounts"
+	kindPayment  recordKind = "payments"
+	kindFavorite recordKind = "favorites"
+	kindTransfer recordKind = "transfers"
+	kindDeposit  recordKind = "deposits"
+	kindPosting  recordKind = "journal"
+	kindKey      recordKind = "idempotency"
+)
+
+// kindCheckpoint - the kind of the change which isn't a record: the checkpoint
+// of the last increment imported(importedCheckpoint), not written to the dumps.
+const kindCheckpoint recordKind = "checkpoint"
+
+// recordKinds - all kinds of the stored records in the order of the dump.
+var recordKinds = []recordKind{
+	kindAccount, kindPayment, kindFavorite, kindTransfer, kindDeposit, kindPosting, kindKey,
+}
+
+// change - a single change made by the transaction: the saved record
+// (types.Account, types.Payment, ...) or the ID of the deleted one.
+type change struct {
+	kind   recordKind
+	delete bool
+	record interface{}
+}
+
+// MemoryStorage - storage which keeps the data in memory.
+type MemoryStorage struct {
+	accounts  []*types.Account
+	payments  []*types.Payment
+	favorites []*types.Favorite
+	transfers []*types.Transfer
+	deposits  []*types.Deposit
+	postings  []*types.Posting
+	keys      []*types.IdempotencyKey
+
+	// indexes over the slices above.
+	accountsByID       map[int64]*types.Account
+	accountsByPhone    map[types.Phone]*types.Account
+	paymentsByID       map[string]*types.Payment
+	paymentsByAccount  map[int64][]*types.Payment
+	favoritesByID      map[string]*types.Favorite
+	favoritesByAccount map[int64][]*types.Favorite
+	transfersByID      map[string]*types.Transfer
+	depositsByID       map[string]*types.Deposit
+	depositsByAccount  map[int64][]*types.Deposit
+	postingsByID       map[string]*types.Posting
+	postingsByLedger   map[types.LedgerAccount][]*types.Posting
+	ledgerBalances     map[types.LedgerAccount]types.Money
+	keysByKey          map[string]*types.IdempotencyKey
+
+	// epoch - identifies the storage in the checkpoints, seq - the number
+	// of the commits applied, changed - the commit which changed every
+	// record last, by the kinds and the IDs, compacted - the commit up to
+	// which the changes are forgotten by compact, lastIncrement - the
+	// checkpoint of the last increment imported.
+	epoch         string
+	seq           uint64
+	changed       map[recordKind]map[string]recordChange
+	compacted     uint64
+	lastIncrement string
+}
+
+// NewMemoryStorage - creates an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		accountsByID:       make(map[int64]*types.Account),
+		accountsByPhone:    make(map[types.Phone]*types.Account),
+		paymentsByID:       make(map[string]*types.Payment),
+		paymentsByAccount:  make(map[int64][]*types.Payment),
+		favoritesByID:      make(map[string]*types.Favorite),
+		favoritesByAccount: make(map[int64][]*types.Favorite),
+		transfersByID:      make(map[string]*types.Transfer),
+		depositsByID:       make(map[string]*types.Deposit),
+		depositsByAccount:  make(map[int64][]*types.Deposit),
+		postingsByID:       make(map[string]*types.Posting),
+		postingsByLedger:   make(map[types.LedgerAccount][]*types.Posting),
+		ledgerBalances:     make(map[types.LedgerAccount]types.Money),
+		keysByKey:          make(map[string]*types.IdempotencyKey),
+		epoch:              uuid.New().String(),
+		changed:            make(map[recordKind]map[string]recordChange),
+	}
+}
+
+// Account - returns the account by ID.
+func (m *MemoryStorage) Account(id int64) (*types.Account, error) {
+	account, ok := m.accountsByID[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// AccountByPhone - returns the account by phone number.
+func (m *MemoryStorage) AccountByPhone(phone types.Phone) (*types.Account, error) {
+	account, ok := m.accountsByPhone[phone]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// Accounts - returns all accounts in the order they were added.
+func (m *MemoryStorage) Accounts() []*types.Account {
+	return m.accounts
+}
+
+// Payment - returns the payment by ID.
+func (m *MemoryStorage) Payment(id string) (*types.Payment, error) {
+	payment, ok := m.paymentsByID[id]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	return payment, nil
+}
+
+// Payments - returns all payments in the order they were added.
+func (m *MemoryStorage) Payments() []*types.Payment {
+	return m.payments
+}
+
+// PaymentsByAccount - returns payments of the account.
+func (m *MemoryStorage) PaymentsByAccount(accountID int64) []*types.Payment {
+	return m.paymentsByAccount[accountID]
+}
+
+// Favorite - returns the favorite by ID.
+func (m *MemoryStorage) Favorite(id string) (*types.Favorite, error) {
+	favorite, ok := m.favoritesByID[id]
+	if !ok {
+		return nil, ErrFavoriteNotFound
+	}
+	return favorite, nil
+}
+
+// Favorites - returns all favorites in the order they were added.
+func (m *MemoryStorage) Favorites() []*types.Favorite {
+	return m.favorites
+}
+
+// FavoritesByAccount - returns favorites of the account.
+func (m *MemoryStorage) FavoritesByAccount(accountID int64) []*types.Favorite {
+	return m.favoritesByAccount[accountID]
+}
+
+// Transfer - returns the transfer by ID.
+func (m *MemoryStorage) Transfer(id string) (*types.Transfer, error) {
+	transfer, ok := m.transfersByID[id]
+	if !ok {
+		return nil, ErrTransferNotFound
+	}
+	return transfer, nil
+}
+
+// Transfers - returns all transfers in the order they were added.
+func (m *MemoryStorage) Transfers() []*types.Transfer {
+	return m.transfers
+}
+
+// Deposits - returns all deposits in the order they were added.
+func (m *MemoryStorage) Deposits() []*types.Deposit {
+	return m.deposits
+}
+
+// DepositsByAccount - returns deposits of the account.
+func (m *MemoryStorage) DepositsByAccount(accountID int64) []*types.Deposit {
+	return m.depositsByAccount[accountID]
+}
+
+// Postings - returns the journal in the order it was written.
+func (m *MemoryStorage) Postings() []*types.Posting {
+	return m.postings
+}
+
+// PostingsByLedger - returns postings which have a line of the journal account.
+func (m *MemoryStorage) PostingsByLedger(account types.LedgerAccount) []*types.Posting {
+	return m.postingsByLedger[account]
+}
+
+// LedgerBalance - returns credits minus debits of the journal account.
+func (m *MemoryStorage) LedgerBalance(account types.LedgerAccount) types.Money {
+	return m.ledgerBalances[account]
+}
+
+// IdempotencyKey - returns the result remembered for the idempotency key.
+func (m *MemoryStorage) IdempotencyKey(key string) (*types.IdempotencyKey, error) {
+	record, ok := m.keysByKey[key]
+	if !ok {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	return record, nil
+}
+
+// IdempotencyKeys - returns all remembered idempotency keys.
+func (m *MemoryStorage) IdempotencyKeys() []*types.IdempotencyKey {
+	return m.keys
+}
+
+// Begin - starts a new transaction.
+func (m *MemoryStorage) Begin() Tx {
+	return &memoryTx{commit: func(changes []change) error {
+		m.apply(changes)
+		return nil
+	}}
+}
+
+// apply - applies the changes to the data and indexes. Existing records
+// are replaced in place, so the pointers returned earlier stay valid.
+// The changes are applied as a single commit of the checkpoints.
+func (m *MemoryStorage) apply(changes []change) {
+	m.seq++
+	for _, c := range changes {
+		if checkpoint, ok := c.record.(importedCheckpoint); ok {
+			m.lastIncrement = string(checkpoint)
+			continue
+		}
+
+		m.track(c)
+		if c.delete {
+			m.delete(c)
+			continue
+		}
+
+		switch record := c.record.(type) {
+		case types.Account:
+			m.saveAccount(record)
+		case types.Payment:
+			m.savePayment(record)
+		case types.Favorite:
+			m.saveFavorite(record)
+		case types.Transfer:
+			m.saveTransfer(record)
+		case types.Deposit:
+			m.saveDeposit(record)
+		case types.Posting:
+			m.savePosting(record)
+		case types.IdempotencyKey:
+			m.saveKey(record)
+		}
+	}
+}
+
+// saveAccount - adds or replaces the account.
+func (m *MemoryStorage) saveAccount(account types.Account) {
+	existing, ok := m.accountsByID[account.ID]
+	if !ok {
+		existing = &types.Account{}
+		*existing = account
+		m.accounts = append(m.accounts, existing)
+		m.accountsByID[account.ID] = existing
+		m.accountsByPhone[account.Phone] = existing
+		return
+	}
+
+	if existing.Phone != account.Phone && m.accountsByPhone[existing.Phone] == existing {
+		delete(m.accountsByPhone, existing.Phone)
+	}
+	*existing = account
+	m.accountsByPhone[account.Phone] = existing
+}
+
+// savePayment - adds or replaces the payment.
+func (m *MemoryStorage) savePayment(payment types.Payment) {
+	existing, ok := m.paymentsByID[payment.ID]
+	if !ok {
+		existing = &types.Payment{}
+		*existing = payment
+		m.payments = append(m.payments, existing)
+		m.paymentsByID[payment.ID] = existing
+		m.paymentsByAccount[payment.AccountID] = append(m.paymentsByAccount[payment.AccountID], existing)
+		return
+	}
+
+	if existing.AccountID != payment.AccountID {
+		m.paymentsByAccount[existing.AccountID] = removePayment(m.paymentsByAccount[existing.AccountID], existing)
+		m.paymentsByAccount[payment.AccountID] = append(m.paymentsByAccount[payment.AccountID], existing)
+	}
+	*existing = payment
+}
+
+// saveFavorite - adds or replaces the favorite.
+func (m *MemoryStorage) saveFavorite(favorite types.Favorite) {
+	existing, ok := m.favoritesByID[favorite.ID]
+	if !ok {
+		existing = &types.Favorite{}
+		*existing = favorite
+		m.favorites = append(m.favorites, existing)
+		m.favoritesByID[favorite.ID] = existing
+		m.favoritesByAccount[favorite.AccountID] = append(m.favoritesByAccount[favorite.AccountID], existing)
+		return
+	}
+
+	if existing.AccountID != favorite.AccountID {
+		m.favoritesByAccount[existing.AccountID] = removeFavorite(m.favoritesByAccount[existing.AccountID], existing)
+		m.favoritesByAccount[favorite.AccountID] = append(m.favoritesByAccount[favorite.AccountID], existing)
+	}
+	*existing = favorite
+}
+
+// saveTransfer - adds or replaces the transfer.
+func (m *MemoryStorage) saveTransfer(transfer types.Transfer) {
+	existing, ok := m.transfersByID[transfer.ID]
+	if !ok {
+		existing = &types.Transfer{}
+		m.transfers = append(m.transfers, existing)
+		m.transfersByID[transfer.ID] = existing
+	}
+	*existing = transfer
+}
+
+// saveDeposit - adds the deposit, deposits never change.
+func (m *MemoryStorage) saveDeposit(deposit types.Deposit) {
+	if _, ok := m.depositsByID[deposit.ID]; ok {
+		return
+	}
+
+	saved := &types.Deposit{}
+	*saved = deposit
+	m.deposits = append(m.deposits, saved)
+	m.depositsByID[deposit.ID] = saved
+	m.depositsByAccount[deposit.AccountID] = append(m.depositsByAccount[deposit.AccountID], saved)
+}
+
+// savePosting - adds the posting to the journal, postings never change.
+func (m *MemoryStorage) savePosting(posting types.Posting) {
+	if _, ok := m.postingsByID[posting.ID]; ok {
+		return
+	}
+
+	saved := &types.Posting{}
+	*saved = posting
+	saved.Lines = append([]types.Line(nil), posting.Lines...)
+	m.postings = append(m.postings, saved)
+	m.postingsByID[posting.ID] = saved
+
+	for i, line := range saved.Lines {
+		if !lineSeen(saved.Lines[:i], line.Account) {
+			m.postingsByLedger[line.Account] = append(m.postingsByLedger[line.Account], saved)
+		}
+		m.ledgerBalances[line.Account] += line.Credit - line.Debit
+	}
+}
+
+// saveKey - adds or replaces the idempotency key.
+func (m *MemoryStorage) saveKey(record types.IdempotencyKey) {
+	existing, ok := m.keysByKey[record.Key]
+	if !ok {
+		existing = &types.IdempotencyKey{}
+		m.keys = append(m.keys, existing)
+		m.keysByKey[record.Key] = existing
+	}
+	*existing = record
+}
+
+// delete - removes the record with the ID given in the change.
+func (m *MemoryStorage) delete(c change) {
+	switch c.kind {
+	case kindAccount:
+		id := c.record.(int64)
+		account, ok := m.accountsByID[id]
+		if !ok {
+			return
+		}
+		delete(m.accountsByID, id)
+		if m.accountsByPhone[account.Phone] == account {
+			delete(m.accountsByPhone, account.Phone)
+		}
+		for i, a := range m.accounts {
+			if a == account {
+				m.accounts = append(m.accounts[:i:i], m.accounts[i+1:]...)
+				break
+			}
+		}
+	case kindPayment:
+		payment, ok := m.paymentsByID[c.record.(string)]
+		if !ok {
+			return
+		}
+		delete(m.paymentsByID, payment.ID)
+		m.paymentsByAccount[payment.AccountID] = removePayment(m.paymentsByAccount[payment.AccountID], payment)
+		m.payments = removePayment(m.payments, payment)
+	case kindFavorite:
+		favorite, ok := m.favoritesByID[c.record.(string)]
+		if !ok {
+			return
+		}
+		delete(m.favoritesByID, favorite.ID)
+		m.favoritesByAccount[favorite.AccountID] = removeFavorite(m.favoritesByAccount[favorite.AccountID], favorite)
+		m.favorites = removeFavorite(m.favorites, favorite)
+	case kindTransfer:
+		transfer, ok := m.transfersByID[c.record.(string)]
+		if !ok {
+			return
+		}
+		delete(m.transfersByID, transfer.ID)
+		for i, t := range m.transfers {
+			if t == transfer {
+				m.transfers = append(m.transfers[:i:i], m.transfers[i+1:]...)
+				break
+			}
+		}
+	case kindDeposit:
+		deposit, ok := m.depositsByID[c.record.(string)]
+		if !ok {
+			return
+		}
+		delete(m.depositsByID, deposit.ID)
+		m.depositsByAccount[deposit.AccountID] = removeDeposit(m.depositsByAccount[deposit.AccountID], deposit)
+		m.deposits = removeDeposit(m.deposits, deposit)
+	case kindPosting:
+		posting, ok := m.postingsByID[c.record.(string)]
+		if !ok {
+			return
+		}
+		delete(m.postingsByID, posting.ID)
+		m.postings = removePosting(m.postings, posting)
+		for i, line := range posting.Lines {
+			if !lineSeen(posting.Lines[:i], line.Account) {
+				m.postingsByLedger[line.Account] = removePosting(m.postingsByLedger[line.Account], posting)
+			}
+			m.ledgerBalances[line.Account] -= line.Credit - line.Debit
+		}
+	}
+}
+
+// removePayment - returns the slice without the payment.
+func removePayment(payments []*types.Payment, payment *types.Payment) []*types.Payment {
+	for i, p := range payments {
+		if p == payment {
+			return append(payments[:i:i], payments[i+1:]...)
+		}
+	}
+	return payments
+}
+
+// removeFavorite - returns the slice without the favorite.
+func removeFavorite(favorites []*types.Favorite, favorite *types.Favorite) []*types.Favorite {
+	for i, f := range favorites {
+		if f == favorite {
+			return append(favorites[:i:i], favorites[i+1:]...)
+		}
+	}
+	return favorites
+}
+
+// removeDeposit - returns the slice without the deposit.
+func removeDeposit(deposits []*types.Deposit, deposit *types.Deposit) []*types.Deposit {
+	for i, d := range deposits {
+		if d == deposit {
+			return append(deposits[:i:i], deposits[i+1:]...)
+		}
+	}
+	return deposits
+}
+
+// removePosting - returns the slice without the posting.
+func removePosting(postings []*types.Posting, posting *types.Posting) []*types.Posting {
+	for i, p := range postings {
+		if p == posting {
+			return append(postings[:i:i], postings[i+1:]...)
+		}
+	}
+	return postings
+}
+
+// memoryTx - transaction which collects the changes and passes them
+// to the commit function of the storage.
+type memoryTx struct {
+	changes []change
+	done    bool
+	commit  func(changes []change) error
+}
+
+// SaveAccount - adds or replaces the account.
+func (tx *memoryTx) SaveAccount(account types.Account) {
+	tx.changes = append(tx.changes, change{kind: kindAccount, record: account})
+}
+
+// SavePayment - adds or replaces the payment.
+func (tx *memoryTx) SavePayment(payment types.Payment) {
+	tx.changes = append(tx.changes, change{kind: kindPayment, record: payment})
+}
+
+// SaveFavorite - adds or replaces the favorite.
+func (tx *memoryTx) SaveFavorite(favorite types.Favorite) {
+	tx.changes = append(tx.changes, change{kind: kindFavorite, record: favorite})
+}
+
+// SaveTransfer - adds or replaces the transfer.
+func (tx *memoryTx) SaveTransfer(transfer types.Transfer) {
+	tx.changes = append(tx.changes, change{kind: kindTransfer, record: transfer})
+}
+
+// SaveDeposit - adds the deposit.
+func (tx *memoryTx) SaveDeposit(deposit types.Deposit) {
+	tx.changes = append(tx.changes, change{kind: kindDeposit, record: deposit})
+}
+
+// SavePosting - adds the posting to the journal.
+func (tx *memoryTx) SavePosting(posting types.Posting) {
+	tx.changes = append(tx.changes, change{kind: kindPosting, record: posting})
+}
+
+// SaveIdempotencyKey - adds or replaces the idempotency key.
+func (tx *memoryTx) SaveIdempotencyKey(key types.IdempotencyKey) {
+	tx.changes = append(tx.changes, change{kind: kindKey, record: key})
+}
+
+// saveCheckpoint - remembers the checkpoint of the last increment imported.
+func (tx *memoryTx) saveCheckpoint(checkpoint string) {
+	tx.changes = append(tx.changes, change{kind: kindCheckpoint, record: importedCheckpoint(checkpoint)})
+}
+
+// DeleteAccount - removes the account.
+func (tx *memoryTx) DeleteAccount(id int64) {
+	tx.changes = append(tx.changes, change{kind: kindAccount, delete: true, record: id})
+}
+
+// DeletePayment - removes the payment.
+func (tx *memoryTx) DeletePayment(id string) {
+	tx.changes = append(tx.changes, change{kind: kindPayment, delete: true, record: id})
+}
+
+// DeleteFavorite - removes the favorite.
+func (tx *memoryTx) DeleteFavorite(id string) {
+	tx.changes = append(tx.changes, change{kind: kindFavorite, delete: true, record: id})
+}
+
+// DeleteTransfer - removes the transfer.
+func (tx *memoryTx) DeleteTransfer(id string) {
+	tx.changes = append(tx.changes, change{kind: kindTransfer, delete: true, record: id})
+}
+
+// DeleteDeposit - removes the deposit.
+func (tx *memoryTx) DeleteDeposit(id string) {
+	tx.changes = append(tx.changes, change{kind: kindDeposit, delete: true, record: id})
+}
+
+// DeletePosting - removes the posting from the journal.
+func (tx *memoryTx) DeletePosting(id string) {
+	tx.changes = append(tx.changes, change{kind: kindPosting, delete: true, record: id})
+}
+
+// Commit - applies all changes of the transaction.
+func (tx *memoryTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	if len(tx.changes) == 0 {
+		return nil
+	}
+	return tx.commit(tx.changes)
+}
+
+// Rollback - discards the changes of the transaction.
+func (tx *memoryTx) Rollback() {
+	tx.done = true
+	tx.changes = nil
+}
@@ -0,0 +1,206 @@
+package wallet
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+func TestMemoryStorage_Commit_success(t *testing.T) {
+	m := NewMemoryStorage()
+
+	tx := m.Begin()
+	tx.SaveAccount(types.Account{ID: 1, Phone: "+992000000001", Balance: 10})
+	tx.SavePayment(types.Payment{ID: "p1", AccountID: 1, Amount: 5, Status: types.PaymentStatusInProgress})
+
+	// nothing is visible before the commit.
+	if _, err := m.Account(1); err != ErrAccountNotFound {
+		t.Errorf("Account(): must return ErrAccountNotFound before commit, returned = %v", err)
+	}
+
+	err := tx.Commit()
+	if err != nil {
+		t.Errorf("Commit(): error = %v", err)
+		return
+	}
+
+	account, err := m.AccountByPhone("+992000000001")
+	if err != nil {
+		t.Errorf("AccountByPhone(): error = %v", err)
+		return
+	}
+
+	payments := m.PaymentsByAccount(account.ID)
+	if len(payments) != 1 || payments[0].ID != "p1" {
+		t.Errorf("PaymentsByAccount(): wrong payments = %v", payments)
+	}
+
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("Commit(): must return ErrTxDone, returned = %v", err)
+	}
+}
+
+func TestMemoryStorage_Rollback(t *testing.T) {
+	m := NewMemoryStorage()
+
+	tx := m.Begin()
+	tx.SaveAccount(types.Account{ID: 1, Phone: "+992000000001"})
+	tx.Rollback()
+
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("Commit(): must return ErrTxDone, returned = %v", err)
+	}
+	if accounts := m.Accounts(); len(accounts) != 0 {
+		t.Errorf("Rollback(): changes were applied, accounts = %v", accounts)
+	}
+}
+
+func TestMemoryStorage_save_keepsPointers(t *testing.T) {
+	m := NewMemoryStorage()
+
+	tx := m.Begin()
+	tx.SaveAccount(types.Account{ID: 1, Phone: "+992000000001"})
+	tx.SaveAccount(types.Account{ID: 2, Phone: "+992000000002"})
+	tx.SavePayment(types.Payment{ID: "p1", AccountID: 1, Amount: 5})
+	tx.Commit()
+
+	account, _ := m.Account(1)
+	payment, _ := m.Payment("p1")
+
+	tx = m.Begin()
+	tx.SaveAccount(types.Account{ID: 1, Phone: "+992000000003", Balance: 7})
+	tx.SavePayment(types.Payment{ID: "p1", AccountID: 2, Amount: 5})
+	tx.Commit()
+
+	if account.Phone != "+992000000003" || account.Balance != 7 {
+		t.Errorf("SaveAccount(): the account wasn't replaced in place = %v", account)
+	}
+	if _, err := m.AccountByPhone("+992000000001"); err != ErrAccountNotFound {
+		t.Errorf("AccountByPhone(): old phone is still indexed, error = %v", err)
+	}
+
+	if payment.AccountID != 2 {
+		t.Errorf("SavePayment(): the payment wasn't replaced in place = %v", payment)
+	}
+	if payments := m.PaymentsByAccount(1); len(payments) != 0 {
+		t.Errorf("PaymentsByAccount(): payment wasn't removed from old account = %v", payments)
+	}
+	if payments := m.PaymentsByAccount(2); len(payments) != 1 {
+		t.Errorf("PaymentsByAccount(): payment wasn't added to new account = %v", payments)
+	}
+}
+
+func TestMemoryStorage_Delete(t *testing.T) {
+	m := NewMemoryStorage()
+
+	tx := m.Begin()
+	tx.SaveAccount(types.Account{ID: 1, Phone: "+992000000001"})
+	tx.SavePayment(types.Payment{ID: "p1", AccountID: 1})
+	tx.SaveFavorite(types.Favorite{ID: "f1", AccountID: 1})
+	tx.SaveTransfer(types.Transfer{ID: "t1", FromAccountID: 1, ToAccountID: 2})
+	tx.SaveDeposit(types.Deposit{ID: "d1", AccountID: 1, Amount: 100})
+	tx.SavePosting(types.Posting{ID: "j1", Type: types.EntryDeposit, Reference: "d1", Lines: []types.Line{
+		debit(types.LedgerExternalFunding, 100), credit(types.CustomerLedger(1), 100),
+	}})
+	tx.Commit()
+
+	tx = m.Begin()
+	tx.DeleteAccount(1)
+	tx.DeletePayment("p1")
+	tx.DeleteFavorite("f1")
+	tx.DeleteFavorite("unknown")
+	tx.DeleteTransfer("t1")
+	tx.DeleteDeposit("d1")
+	tx.DeletePosting("j1")
+	tx.Commit()
+
+	if _, err := m.AccountByPhone("+992000000001"); err != ErrAccountNotFound {
+		t.Errorf("DeleteAccount(): account wasn't deleted, error = %v", err)
+	}
+	if _, err := m.Payment("p1"); err != ErrPaymentNotFound {
+		t.Errorf("DeletePayment(): payment wasn't deleted, error = %v", err)
+	}
+	if _, err := m.Favorite("f1"); err != ErrFavoriteNotFound {
+		t.Errorf("DeleteFavorite(): favorite wasn't deleted, error = %v", err)
+	}
+	if _, err := m.Transfer("t1"); err != ErrTransferNotFound {
+		t.Errorf("DeleteTransfer(): transfer wasn't deleted, error = %v", err)
+	}
+	if len(m.Accounts()) != 0 || len(m.Payments()) != 0 || len(m.Favorites()) != 0 ||
+		len(m.Transfers()) != 0 || len(m.Deposits()) != 0 || len(m.Postings()) != 0 {
+		t.Errorf("Delete(): records are still listed")
+	}
+	if len(m.PaymentsByAccount(1)) != 0 || len(m.FavoritesByAccount(1)) != 0 ||
+		len(m.DepositsByAccount(1)) != 0 || len(m.PostingsByLedger(types.CustomerLedger(1))) != 0 {
+		t.Errorf("Delete(): records are still indexed")
+	}
+	if balance := m.LedgerBalance(types.CustomerLedger(1)); balance != 0 {
+		t.Errorf("DeletePosting(): wrong ledger balance = %v", balance)
+	}
+}
+
+// failingStorage - the storage whose commits always fail.
+type failingStorage struct {
+	*MemoryStorage
+}
+
+func (f failingStorage) Begin() Tx {
+	return &memoryTx{commit: func(changes []change) error {
+		return errCommit
+	}}
+}
+
+var errCommit = errors.New("commit failed")
+
+func TestNewService_storage(t *testing.T) {
+	storage := NewMemoryStorage()
+	tx := storage.Begin()
+	tx.SaveAccount(types.Account{ID: 5, Phone: "+992000000005", Balance: 100})
+	tx.Commit()
+
+	s := NewService(storage)
+	account, err := s.RegisterAccount("+992000000006")
+	if err != nil {
+		t.Errorf("RegisterAccount(): error = %v", err)
+		return
+	}
+	if account.ID != 6 {
+		t.Errorf("RegisterAccount(): ID must continue the storage, account = %v", account)
+	}
+
+	payment, err := s.Pay(5, 40, "auto")
+	if err != nil {
+		t.Errorf("Pay(): error = %v", err)
+		return
+	}
+
+	stored, _ := storage.Payment(payment.ID)
+	if !reflect.DeepEqual(stored, payment) {
+		t.Errorf("Pay(): payment isn't kept in the storage = %v", stored)
+	}
+
+	account, _ = storage.Account(5)
+	if account.Balance != 60 {
+		t.Errorf("Pay(): balance isn't changed in the storage = %v", account)
+	}
+}
+
+func TestNewService_commitFails(t *testing.T) {
+	storage := NewMemoryStorage()
+	tx := storage.Begin()
+	tx.SaveAccount(types.Account{ID: 1, Phone: "+992000000001", Balance: 100})
+	tx.Commit()
+
+	s := NewService(failingStorage{storage})
+	_, err := s.Pay(1, 40, "auto")
+	if err != errCommit {
+		t.Errorf("Pay(): must return the error of the commit, returned = %v", err)
+	}
+
+	account, _ := s.FindAccountByID(1)
+	if account.Balance != 100 || len(storage.Payments()) != 0 || len(storage.Postings()) != 0 {
+		t.Errorf("Pay(): changes are kept after the failed commit = %v", account)
+	}
+}
@@ -0,0 +1,304 @@
+package wallet
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// IssueKind - represents the kind of inconsistency found by Verify.
+type IssueKind string
+
+// Predefined kinds of inconsistencies.
+const (
+	IssueDuplicateID       IssueKind = "DUPLICATE_ID"
+	IssueDuplicatePhone    IssueKind = "DUPLICATE_PHONE"
+	IssueMissingAccount    IssueKind = "MISSING_ACCOUNT"
+	IssueInvalidStatus     IssueKind = "INVALID_STATUS"
+	IssueNegativeBalance   IssueKind = "NEGATIVE_BALANCE"
+	IssueBalanceMismatch   IssueKind = "BALANCE_MISMATCH"
+	IssueJournalMismatch   IssueKind = "JOURNAL_MISMATCH"
+	IssueUnbalancedPosting IssueKind = "UNBALANCED_POSTING"
+)
+
+// Issue - represents information about a single inconsistency.
+type Issue struct {
+	Kind    IssueKind
+	Entity  string
+	ID      string
+	Message string
+}
+
+// String - implements fmt.Stringer interface.
+func (i Issue) String() string {
+	return fmt.Sprintf("%s %s %s: %s", i.Kind, i.Entity, i.ID, i.Message)
+}
+
+// Report - represents the result of the integrity check.
+type Report struct {
+	Accounts  int
+	Payments  int
+	Favorites int
+	Transfers int
+	Deposits  int
+	Postings  int
+	Issues    []Issue
+}
+
+// OK - reports whether no inconsistencies were found.
+func (r *Report) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// add - appends the issue to the report.
+func (r *Report) add(kind IssueKind, entity string, id string, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, Issue{
+		Kind:    kind,
+		Entity:  entity,
+		ID:      id,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Verify - checks the consistency of accounts, payments, favorites,
+// transfers, deposits and the journal, and reports every problem found.
+//
+// The balance of every account must be equal to its opening balance plus
+// deposits minus payments plus incoming and minus outgoing transfers(failed
+// payments and transfers are not counted), and to the balance computed from
+// the journal. The opening balances are the opening entries of the journal,
+// posted by the import of the dumps without a journal; the records of such
+// dumps are counted in the opening balances.
+func (s *Service) Verify() *Report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return verifySnapshot(takeSnapshot(s.store()))
+}
+
+// VerifyDir - checks the dump directory the same way as Verify, without
+// importing it. The records are checked as they are written in the files,
+// so the ones listed more than once are reported too, while the import
+// would keep only the last of them. The lines which can't be read are
+// returned as ImportErrors along with the report of the rest.
+func (s *Service) VerifyDir(dir string) (*Report, error) {
+	s.mu.RLock()
+	codec := s.codec
+	s.mu.RUnlock()
+
+	snap, errs, err := readDump(dir, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	// the balances of the dump without a journal are the opening ones,
+	// as for the import.
+	postings := len(snap.postings)
+	if !snap.found[kindPosting] {
+		for i, account := range snap.accounts {
+			ledger := types.CustomerLedger(account.ID)
+			lines := []types.Line{debit(types.LedgerExternalFunding, account.Balance), credit(ledger, account.Balance)}
+			if account.Balance < 0 {
+				lines = []types.Line{debit(ledger, -account.Balance), credit(types.LedgerExternalFunding, -account.Balance)}
+			}
+			snap.postings = append(snap.postings, types.Posting{ID: "opening-" + strconv.Itoa(i), Type: types.EntryOpening, Lines: lines})
+		}
+	}
+
+	report := verifySnapshot(snap)
+	report.Postings = postings
+	if len(errs) > 0 {
+		return report, errs
+	}
+	return report, nil
+}
+
+// verifySnapshot - checks the records of the snapshot, see Verify.
+func verifySnapshot(snap *snapshot) *Report {
+	report := &Report{
+		Accounts:  len(snap.accounts),
+		Payments:  len(snap.payments),
+		Favorites: len(snap.favorites),
+		Transfers: len(snap.transfers),
+		Deposits:  len(snap.deposits),
+		Postings:  len(snap.postings),
+	}
+
+	accounts := make(map[int64]bool, len(snap.accounts))
+	phones := make(map[types.Phone]int64, len(snap.accounts))
+	for _, account := range snap.accounts {
+		id := strconv.FormatInt(account.ID, 10)
+		if accounts[account.ID] {
+			report.add(IssueDuplicateID, "account", id, "account is listed more than once")
+		}
+		accounts[account.ID] = true
+
+		if other, ok := phones[account.Phone]; ok && other != account.ID {
+			report.add(IssueDuplicatePhone, "account", id, "phone %s is registered to account %d too", account.Phone, other)
+		}
+		phones[account.Phone] = account.ID
+
+		if account.Balance < 0 {
+			report.add(IssueNegativeBalance, "account", id, "balance is %d", account.Balance)
+		}
+	}
+
+	// expected balances computed from the records.
+	expected := make(map[int64]types.Money, len(snap.accounts))
+
+	// the accounts with the opening balance and the records posted to the
+	// journal when they were made. The records of such accounts which were
+	// not posted are older than the journal, the opening balance has them.
+	opened := make(map[int64]bool)
+	posted := make(map[types.EntryType]map[string]bool)
+	for _, posting := range snap.postings {
+		if posted[posting.Type] == nil {
+			posted[posting.Type] = make(map[string]bool)
+		}
+		posted[posting.Type][posting.Reference] = true
+
+		for _, line := range posting.Lines {
+			if id, ok := line.Account.AccountID(); ok && posting.Type == types.EntryOpening {
+				opened[id] = true
+			}
+		}
+	}
+	older := make(map[string]bool)
+	olderThanJournal := func(kind types.EntryType, id string, accountIDs ...int64) bool {
+		if posted[kind][id] {
+			return false
+		}
+		for _, accountID := range accountIDs {
+			if !opened[accountID] {
+				return false
+			}
+		}
+		older[id] = true
+		return true
+	}
+
+	seen := make(map[string]bool, len(snap.deposits))
+	for _, deposit := range snap.deposits {
+		if seen[deposit.ID] {
+			report.add(IssueDuplicateID, "deposit", deposit.ID, "deposit is listed more than once")
+		}
+		seen[deposit.ID] = true
+
+		if !accounts[deposit.AccountID] {
+			report.add(IssueMissingAccount, "deposit", deposit.ID, "account %d not found", deposit.AccountID)
+		}
+		if !olderThanJournal(types.EntryDeposit, deposit.ID, deposit.AccountID) {
+			expected[deposit.AccountID] += deposit.Amount
+		}
+	}
+
+	seen = make(map[string]bool, len(snap.payments))
+	for _, payment := range snap.payments {
+		if seen[payment.ID] {
+			report.add(IssueDuplicateID, "payment", payment.ID, "payment is listed more than once")
+		}
+		seen[payment.ID] = true
+
+		if !accounts[payment.AccountID] {
+			report.add(IssueMissingAccount, "payment", payment.ID, "account %d not found", payment.AccountID)
+		}
+
+		if !payment.Status.IsValid() {
+			report.add(IssueInvalidStatus, "payment", payment.ID, "status %q is unknown", payment.Status)
+		}
+
+		if olderThanJournal(types.EntryPayment, payment.ID, payment.AccountID) {
+			continue
+		}
+		if payment.Status != types.PaymentStatusFail {
+			expected[payment.AccountID] -= payment.Amount
+		}
+	}
+
+	seen = make(map[string]bool, len(snap.transfers))
+	for _, transfer := range snap.transfers {
+		if seen[transfer.ID] {
+			report.add(IssueDuplicateID, "transfer", transfer.ID, "transfer is listed more than once")
+		}
+		seen[transfer.ID] = true
+
+		if !accounts[transfer.FromAccountID] {
+			report.add(IssueMissingAccount, "transfer", transfer.ID, "account %d not found", transfer.FromAccountID)
+		}
+		if !accounts[transfer.ToAccountID] {
+			report.add(IssueMissingAccount, "transfer", transfer.ID, "account %d not found", transfer.ToAccountID)
+		}
+
+		if !transfer.Status.IsValid() {
+			report.add(IssueInvalidStatus, "transfer", transfer.ID, "status %q is unknown", transfer.Status)
+		}
+
+		if olderThanJournal(types.EntryTransfer, transfer.ID, transfer.FromAccountID, transfer.ToAccountID) {
+			continue
+		}
+		if transfer.Status != types.PaymentStatusFail {
+			expected[transfer.FromAccountID] -= transfer.Amount
+			expected[transfer.ToAccountID] += transfer.Amount
+		}
+	}
+
+	seen = make(map[string]bool, len(snap.favorites))
+	for _, favorite := range snap.favorites {
+		if seen[favorite.ID] {
+			report.add(IssueDuplicateID, "favorite", favorite.ID, "favorite is listed more than once")
+		}
+		seen[favorite.ID] = true
+
+		if !accounts[favorite.AccountID] {
+			report.add(IssueMissingAccount, "favorite", favorite.ID, "account %d not found", favorite.AccountID)
+		}
+	}
+
+	// balances of the journal accounts computed from the postings.
+	journal := make(map[types.LedgerAccount]types.Money)
+
+	seen = make(map[string]bool, len(snap.postings))
+	for _, posting := range snap.postings {
+		if seen[posting.ID] {
+			report.add(IssueDuplicateID, "posting", posting.ID, "posting is listed more than once")
+		}
+		seen[posting.ID] = true
+
+		var debits, credits types.Money
+		for _, line := range posting.Lines {
+			debits += line.Debit
+			credits += line.Credit
+			journal[line.Account] += line.Credit - line.Debit
+
+			id, ok := line.Account.AccountID()
+			if ok && !accounts[id] {
+				report.add(IssueMissingAccount, "posting", posting.ID, "account %d not found", id)
+			}
+			// the opening balances and the refunds(reversals) of the records
+			// older than the journal are known from the journal only.
+			if ok && (posting.Type == types.EntryOpening || older[posting.Reference]) {
+				expected[id] += line.Credit - line.Debit
+			}
+		}
+		if debits != credits {
+			report.add(IssueUnbalancedPosting, "posting", posting.ID, "debits %d, credits %d", debits, credits)
+		}
+	}
+
+	for _, account := range snap.accounts {
+		id := strconv.FormatInt(account.ID, 10)
+		if account.Balance != expected[account.ID] {
+			report.add(IssueBalanceMismatch, "account", id,
+				"balance is %d, opening balance, deposits, payments and transfers give %d", account.Balance, expected[account.ID])
+		}
+
+		ledger := journal[types.CustomerLedger(account.ID)]
+		if account.Balance != ledger {
+			report.add(IssueJournalMismatch, "account", id,
+				"balance is %d, journal gives %d", account.Balance, ledger)
+		}
+	}
+
+	return report
+}
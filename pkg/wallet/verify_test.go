@@ -0,0 +1,198 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+func TestService_Verify_success(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	_, err := s.Transfer(1, 2, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(3, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	report := s.Verify()
+	if !report.OK() {
+		t.Errorf("Verify(): unexpected issues = %v", report.Issues)
+	}
+
+	if report.Accounts != 3 || report.Payments != 13 || report.Transfers != 1 || report.Deposits != 3 {
+		t.Errorf("Verify(): wrong counters = %+v", report)
+	}
+}
+
+func TestService_Verify_issues(t *testing.T) {
+	s := newTestService()
+	Transactions(s)
+
+	// an account listed twice, a payment and a favorite of a deleted account,
+	// a balance changed without any record.
+	m := s.memory()
+	m.accounts = append(m.accounts, m.accounts[0])
+	m.payments = append(m.payments, &types.Payment{ID: "p1", AccountID: 9, Amount: 1, Status: "DONE"})
+	m.favorites = append(m.favorites, &types.Favorite{ID: "f1", AccountID: 8})
+	m.accounts[1].Balance += 5
+
+	report := s.Verify()
+	want := map[IssueKind]int{
+		IssueDuplicateID:     1,
+		IssueMissingAccount:  2,
+		IssueInvalidStatus:   1,
+		IssueBalanceMismatch: 1,
+		IssueJournalMismatch: 1,
+	}
+
+	result := map[IssueKind]int{}
+	for _, issue := range report.Issues {
+		result[issue.Kind]++
+	}
+
+	for kind, count := range want {
+		if result[kind] != count {
+			t.Errorf("Verify(): wrong number of %v issues = %v, issues = %v", kind, result[kind], report.Issues)
+		}
+	}
+}
+
+func TestService_Verify_import(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/accounts.dump", []byte("1;+1111;400\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = os.WriteFile(dir+"/favorites.dump", []byte("f1;2;my phone;100;phone\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the balance is the opening one, the favorite points at a missing account.
+	report := s.Verify()
+	if len(report.Issues) != 1 {
+		t.Errorf("Verify(): wrong issues = %v", report.Issues)
+		return
+	}
+
+	if report.Issues[0].Kind != IssueMissingAccount || report.Issues[0].ID != "f1" {
+		t.Errorf("Verify(): wrong issue = %v", report.Issues[0])
+	}
+}
+
+func TestService_Verify_legacyImport(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/accounts.dump", []byte("1;+992;100\n2;+993;0\n"), 0666)
+	if err == nil {
+		err = os.WriteFile(dir+"/payments.dump", []byte("p1;1;30;food;INPROGRESS\n"), 0666)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the balances of the dump are the opening ones, they have the payment.
+	if report := s.Verify(); !report.OK() {
+		t.Errorf("Verify(): issues after the import of the dump = %v", report.Issues)
+	}
+
+	report, err := s.VerifyDir(dir)
+	if err != nil || !report.OK() || report.Postings != 0 {
+		t.Errorf("VerifyDir(): wrong report of the dump = %+v, error = %v", report, err)
+	}
+
+	err = s.Deposit(2, 40)
+	if err == nil {
+		_, err = s.Transfer(2, 1, 15)
+	}
+	if err == nil {
+		err = s.Reject("p1")
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if report := s.Verify(); !report.OK() {
+		t.Errorf("Verify(): issues after the changes = %v", report.Issues)
+	}
+}
+
+func TestService_VerifyDir_duplicates(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/accounts.dump", []byte("1;+1111;0\n1;+2222;0\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	report, err := s.VerifyDir(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the import keeps one of them, the files list the account twice.
+	if report.Accounts != 2 || len(report.Issues) != 1 || report.Issues[0].Kind != IssueDuplicateID {
+		t.Errorf("VerifyDir(): wrong report = %+v", report)
+	}
+
+	if len(s.store().Accounts()) != 0 {
+		t.Errorf("VerifyDir(): the dump must not be imported")
+	}
+}
+
+func TestService_VerifyDir_rejected(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/accounts.dump", []byte("1;+1111;0\nx;+2222;0\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	report, err := s.VerifyDir(dir)
+	var errs ImportErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Line != 2 {
+		t.Errorf("VerifyDir(): must return the rejected line, returned = %v", err)
+	}
+
+	// the rest is checked anyway.
+	if report == nil || report.Accounts != 1 || !report.OK() {
+		t.Errorf("VerifyDir(): wrong report = %+v", report)
+	}
+}
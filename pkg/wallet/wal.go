@@ -0,0 +1,178 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/SardorMS/wallet/pkg/types"
+)
+
+// Lines of the write-ahead log.
+//
+// Every committed transaction is written as its changes, one per line:
+//
+//	<kind>;save;<the dump line of the record>
+//	<kind>;delete;<ID>
+//	checkpoint;save;<checkpoint of the last increment imported>
+//
+// followed by the line closing it:
+//
+//	COMMIT;<number of changes>;<crc32 of the change lines>
+//
+// The transaction without a valid closing line was cut by a crash
+// and is dropped on recovery.
+const (
+	walSave   = "save"
+	walDelete = "delete"
+	walCommit = "COMMIT"
+)
+
+// encodeTx - returns the lines of the write-ahead log for the transaction.
+func encodeTx(changes []change) []byte {
+	var buf bytes.Buffer
+	for _, c := range changes {
+		buf.WriteString(encodeChange(c) + "\n")
+	}
+	sum := crc32.ChecksumIEEE(buf.Bytes())
+	buf.WriteString(walCommit + ";" + strconv.Itoa(len(changes)) + ";" + strconv.FormatUint(uint64(sum), 10) + "\n")
+	return buf.Bytes()
+}
+
+// encodeChange - returns the line of the write-ahead log for the change.
+func encodeChange(c change) string {
+	if c.delete {
+		switch id := c.record.(type) {
+		case int64:
+			return string(c.kind) + ";" + walDelete + ";" + strconv.FormatInt(id, 10)
+		case string:
+			return string(c.kind) + ";" + walDelete + ";" + escapeField(id)
+		}
+	}
+
+	line := ""
+	switch record := c.record.(type) {
+	case types.Account:
+		line = formatAccount(record)
+	case types.Payment:
+		line = formatPayment(record)
+	case types.Favorite:
+		line = formatFavorite(record)
+	case types.Transfer:
+		line = formatTransfer(record)
+	case types.Deposit:
+		line = formatDeposit(record)
+	case types.Posting:
+		line = formatPosting(record)
+	case types.IdempotencyKey:
+		line = formatKey(record)
+	case importedCheckpoint:
+		line = escapeField(string(record))
+	}
+	return string(c.kind) + ";" + walSave + ";" + line
+}
+
+// decodeChange - reads the change from the line of the write-ahead log.
+func decodeChange(line string) (change, error) {
+	fields := splitRecord(line, ';')
+	if len(fields) < 3 {
+		return change{}, ErrBadLogRecord
+	}
+
+	kind := recordKind(fields[0])
+	switch fields[1] {
+	case walDelete:
+		c := change{kind: kind, delete: true, record: fields[2]}
+		if kind == kindAccount {
+			id, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return change{}, ErrBadLogRecord
+			}
+			c.record = id
+		}
+		return c, nil
+
+	case walSave:
+		if kind == kindCheckpoint {
+			return change{kind: kind, record: importedCheckpoint(fields[2])}, nil
+		}
+
+		snap := &snapshot{}
+		if err := snap.decode(kind, fields[2:]); err != nil {
+			return change{}, fmt.Errorf("%w: %v", ErrBadLogRecord, err)
+		}
+		changes := snap.changes()
+		if len(changes) != 1 {
+			return change{}, ErrBadLogRecord
+		}
+		return changes[0], nil
+	}
+	return change{}, ErrBadLogRecord
+}
+
+// readLog - returns the changes of every complete transaction of the log
+// and the length of the log they take, the rest of it is a torn write.
+func readLog(data []byte) ([][]change, int, error) {
+	txs := [][]change{}
+	valid := 0
+
+	var pending []string
+	offset := 0
+	start := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		offset += len(line) + 1
+		if offset > len(data) {
+			// the last line has no newline, so it wasn't written completely.
+			break
+		}
+
+		if !strings.HasPrefix(line, walCommit+";") {
+			pending = append(pending, line)
+			continue
+		}
+
+		if !validCommit(line, data[start:offset-len(line)-1], len(pending)) {
+			break
+		}
+
+		changes := make([]change, 0, len(pending))
+		for _, text := range pending {
+			c, err := decodeChange(text)
+			if err != nil {
+				return nil, 0, err
+			}
+			changes = append(changes, c)
+		}
+		txs = append(txs, changes)
+
+		pending = nil
+		valid = offset
+		start = offset
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return txs, valid, nil
+}
+
+// validCommit - reports whether the closing line matches the change lines.
+func validCommit(line string, lines []byte, count int) bool {
+	fields := strings.Split(line, ";")
+	if len(fields) != 3 {
+		return false
+	}
+
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n != count {
+		return false
+	}
+
+	sum, err := strconv.ParseUint(fields[2], 10, 32)
+	return err == nil && uint32(sum) == crc32.ChecksumIEEE(lines)
+}